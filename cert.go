@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultCertDir 证书的默认目录, 与wsproxy默认读取证书的位置相同.
+	defaultCertDir = ".wsproxy/certs"
+
+	caName  = "ca"
+	crlName = "ca.crl"
+)
+
+const certUsage = `usage: wsproxy cert <command> [options]
+
+commands:
+  ca      create the certificate authority (ca.crt, ca.key)
+  server  issue the server certificate (server.crt, server.key)
+  client  issue a client certificate (client.crt, client.key or <name>.crt, <name>.key)
+  revoke  revoke a client certificate and update ca.crl
+
+run 'wsproxy cert <command> -help' for the options of a command.`
+
+// certCommand 执行 wsproxy cert 子命令, 返回进程退出码.
+func certCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Println(certUsage)
+		return 2
+	}
+
+	commands := map[string]func([]string) error{
+		"ca":     certCA,
+		"server": certServer,
+		"client": certClient,
+		"revoke": certRevoke,
+	}
+
+	cmd, found := commands[args[0]]
+	if !found {
+		fmt.Println(certUsage)
+		return 2
+	}
+
+	if err := cmd(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return 2
+		}
+		fmt.Println("wsproxy cert", args[0]+":", err)
+		return 1
+	}
+
+	return 0
+}
+
+// certCA 创建自签名的ca证书及私钥.
+func certCA(args []string) error {
+	fs := flag.NewFlagSet("wsproxy cert ca", flag.ContinueOnError)
+	dir := fs.String("dir", defaultCertDir, "certificate directory")
+	cn := fs.String("cn", "wsproxy CA", "common name")
+	days := fs.Int("days", 3650, "validity in days")
+	force := fs.Bool("force", false, "overwrite the existing ca")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := checkOverwrite(*dir, caName, *force); err != nil {
+		return err
+	}
+
+	template, err := newTemplate(*cn, *days)
+	if err != nil {
+		return err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	return issue(*dir, caName, template, nil, nil)
+}
+
+// certServer 签发服务端证书, SAN 为域名或ip.
+func certServer(args []string) error {
+	fs := flag.NewFlagSet("wsproxy cert server", flag.ContinueOnError)
+	dir := fs.String("dir", defaultCertDir, "certificate directory")
+	cn := fs.String("cn", "", "common name, default is the first san")
+	san := fs.String("san", "localhost", "comma separated dns names and ip addresses")
+	days := fs.Int("days", 825, "validity in days")
+	force := fs.Bool("force", false, "overwrite the existing certificate and key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := checkOverwrite(*dir, "server", *force); err != nil {
+		return err
+	}
+
+	var names []string
+	for _, v := range strings.Split(*san, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			names = append(names, v)
+		}
+	}
+	if len(names) == 0 {
+		return errors.New("no san")
+	}
+	if *cn == "" {
+		*cn = names[0]
+	}
+
+	template, err := newTemplate(*cn, *days)
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+
+	ca, caKey, err := loadCA(*dir)
+	if err != nil {
+		return err
+	}
+
+	return issue(*dir, "server", template, ca, caKey)
+}
+
+// certClient 签发客户端证书, 名称不是client时写入 <name>.crt 及 <name>.key, 通过 -client-cert 等参数使用.
+func certClient(args []string) error {
+	fs := flag.NewFlagSet("wsproxy cert client", flag.ContinueOnError)
+	dir := fs.String("dir", defaultCertDir, "certificate directory")
+	name := fs.String("name", "client", "file name of the certificate and key")
+	cn := fs.String("cn", "", "common name, default is the name")
+	days := fs.Int("days", 825, "validity in days")
+	force := fs.Bool("force", false, "overwrite the existing certificate and key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *name == "" || *name == caName || *name == "server" || strings.ContainsAny(*name, `/\`) {
+		return fmt.Errorf("invalid name %q", *name)
+	}
+	if err := checkOverwrite(*dir, *name, *force); err != nil {
+		return err
+	}
+	if *cn == "" {
+		*cn = *name
+	}
+
+	template, err := newTemplate(*cn, *days)
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	ca, caKey, err := loadCA(*dir)
+	if err != nil {
+		return err
+	}
+
+	return issue(*dir, *name, template, ca, caKey)
+}
+
+// certRevoke 吊销客户端证书, 重新签发 ca.crl.
+func certRevoke(args []string) error {
+	fs := flag.NewFlagSet("wsproxy cert revoke", flag.ContinueOnError)
+	dir := fs.String("dir", defaultCertDir, "certificate directory")
+	name := fs.String("name", "", "name of the client certificate to revoke")
+	serial := fs.String("serial", "", "serial number (hex) of the certificate to revoke")
+	days := fs.Int("days", 365, "days until the next crl update")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var number *big.Int
+	switch {
+	case *name != "" && *serial != "":
+		return errors.New("use either -name or -serial")
+	case *name != "":
+		cert, err := readCert(filepath.Join(*dir, *name+".crt"))
+		if err != nil {
+			return err
+		}
+		number = cert.SerialNumber
+	case *serial != "":
+		n, ok := new(big.Int).SetString(strings.ReplaceAll(*serial, ":", ""), 16)
+		if !ok {
+			return fmt.Errorf("invalid serial %q", *serial)
+		}
+		number = n
+	default:
+		return errors.New("-name or -serial is required")
+	}
+
+	ca, caKey, err := loadCA(*dir)
+	if err != nil {
+		return err
+	}
+
+	// 保留已吊销的证书, CRL序号递增.
+	list := &x509.RevocationList{Number: big.NewInt(1)}
+	crlPath := filepath.Join(*dir, crlName)
+	if data, err := ioutil.ReadFile(crlPath); err == nil {
+		old, err := parseCRL(data)
+		if err != nil {
+			return err
+		}
+		for _, entry := range old.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(number) == 0 {
+				fmt.Println("Certificate", fmt.Sprintf("%x", number), "already revoked")
+				return nil
+			}
+		}
+		list.RevokedCertificateEntries = old.RevokedCertificateEntries
+		if old.Number != nil {
+			list.Number = new(big.Int).Add(old.Number, big.NewInt(1))
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	now := time.Now()
+	list.RevokedCertificateEntries = append(list.RevokedCertificateEntries, x509.RevocationListEntry{
+		SerialNumber:   number,
+		RevocationTime: now,
+	})
+	list.ThisUpdate = now
+	list.NextUpdate = now.AddDate(0, 0, *days)
+
+	der, err := x509.CreateRevocationList(rand.Reader, list, ca, caKey)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(crlPath, "X509 CRL", der, 0644); err != nil {
+		return err
+	}
+
+	fmt.Println("Revoked", fmt.Sprintf("%x", number), "written", crlPath)
+	return nil
+}
+
+// newTemplate 创建证书模板, 序列号为128位随机数.
+func newTemplate(cn string, days int) (*x509.Certificate, error) {
+	if days <= 0 {
+		return nil, fmt.Errorf("invalid days %d", days)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(0, 0, days),
+	}, nil
+}
+
+// checkOverwrite 检查 dir 下的 name.crt 及 name.key 是否已经存在, 没有指定 -force 时不覆盖.
+func checkOverwrite(dir, name string, force bool) error {
+	if force {
+		return nil
+	}
+
+	for _, ext := range []string{".key", ".crt"} {
+		path := filepath.Join(dir, name+ext)
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s already exists, use -force to overwrite", path)
+		}
+	}
+
+	return nil
+}
+
+// issue 生成私钥并签发证书, 写入 dir 下的 name.crt 及 name.key, ca为nil时自签名.
+func issue(dir, name string, template, ca *x509.Certificate, caKey crypto.Signer) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	parent, signer := template, crypto.Signer(key)
+	if ca != nil {
+		parent, signer = ca, caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	if err := writePEM(keyPath, "PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	if err := writePEM(certPath, "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+
+	fmt.Println("Issued", template.Subject.CommonName, "serial", fmt.Sprintf("%x", template.SerialNumber),
+		"written", certPath, keyPath)
+	return nil
+}
+
+// loadCA 读取 dir 下的ca证书及私钥.
+func loadCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	ca, err := readCert(filepath.Join(dir, caName+".crt"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, caName+".key"))
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, errors.New("invalid ca key")
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("unsupported ca key")
+	}
+
+	return ca, signer, nil
+}
+
+func readCert(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parseCRL(data []byte) (*x509.RevocationList, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	return x509.ParseRevocationList(data)
+}
+
+func writePEM(path, typ string, der []byte, mode os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := ioutil.WriteFile(path, data, mode); err != nil {
+		return err
+	}
+
+	// 覆盖已有文件时 WriteFile 不修改权限.
+	return os.Chmod(path, mode)
+}
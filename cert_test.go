@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitee.com/jackarain/wsproxy/wsproxy"
+)
+
+// TestCertCommand 签发服务器及客户端证书, 吊销一个客户端证书后remote server拒绝它的握手.
+func TestCertCommand(t *testing.T) {
+	dir := t.TempDir()
+	run := func(args ...string) int {
+		return certCommand(append(args, "-dir", dir))
+	}
+
+	for _, args := range [][]string{
+		{"ca"},
+		{"server", "-san", "127.0.0.1,localhost"},
+		{"client"},
+		{"client", "-name", "bob"},
+	} {
+		if code := run(args...); code != 0 {
+			t.Fatalf("cert %v exit %d", args, code)
+		}
+	}
+
+	// 没有 -force 时不覆盖已有的证书.
+	serverCert := filepath.Join(dir, "server.crt")
+	before, err := ioutil.ReadFile(serverCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"ca"}, {"server", "-san", "127.0.0.1"}, {"client", "-name", "bob"}} {
+		if code := run(args...); code != 1 {
+			t.Fatalf("cert %v without -force exit %d, want 1", args, code)
+		}
+	}
+	if after, _ := ioutil.ReadFile(serverCert); !bytes.Equal(before, after) {
+		t.Fatal("server certificate overwritten without -force")
+	}
+	if code := run("server", "-san", "127.0.0.1", "-force"); code != 0 {
+		t.Fatalf("cert server -force exit %d", code)
+	}
+	if after, _ := ioutil.ReadFile(serverCert); bytes.Equal(before, after) {
+		t.Fatal("server certificate not reissued with -force")
+	}
+
+	if code := run("revoke", "-name", "bob"); code != 0 {
+		t.Fatalf("cert revoke exit %d", code)
+	}
+	if code := run("revoke", "-name", "nobody"); code != 1 {
+		t.Fatalf("revoke of a missing certificate exit %d, want 1", code)
+	}
+
+	// 按配置文件中的证书位置启动remote server, 相对路径相对于配置文件所在的目录.
+	config := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(config, []byte(`{"Certs": {"CA": "ca.crt", "ServerCert": "server.crt",
+		"ServerKey": "server.key", "CRL": "ca.crl", "RequireClientCert": true}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := wsproxy.JSONConfig
+	wsproxy.JSONConfig = config
+	defer func() { wsproxy.JSONConfig = saved }()
+	if _, err := wsproxy.NewServer(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", wsproxy.ServerTLSConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if conn.(*tls.Conn).Handshake() == nil {
+					conn.Write([]byte("ok"))
+				}
+			}()
+		}
+	}()
+
+	pool := x509.NewCertPool()
+	ca, err := ioutil.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil || !pool.AppendCertsFromPEM(ca) {
+		t.Fatalf("load ca: %v", err)
+	}
+
+	// handshake 使用name的客户端证书连接, tls1.3中服务端拒绝客户端证书在客户端第一次读取时返回.
+	handshake := func(name string) error {
+		cert, err := tls.LoadX509KeyPair(filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{cert},
+		})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 2))
+		return err
+	}
+
+	if err := handshake("client"); err != nil {
+		t.Fatalf("valid client certificate rejected: %v", err)
+	}
+	if err := handshake("bob"); err == nil {
+		t.Fatal("revoked client certificate accepted")
+	}
+}
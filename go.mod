@@ -1,9 +1,14 @@
 module gitee.com/jackarain/wsproxy
 
-go 1.14
+go 1.22
 
 require (
-	github.com/gobwas/httphead v0.0.0-20200921212729-da3d93bc3c58 // indirect
-	github.com/gobwas/pool v0.2.1 // indirect
+	github.com/bkaradzic/go-lz4 v1.0.0
+	github.com/gobwas/httphead v0.0.0-20200921212729-da3d93bc3c58
 	github.com/gobwas/ws v1.0.4
+	github.com/golang/snappy v1.0.0
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/net v0.10.0
 )
+
+require github.com/gobwas/pool v0.2.1 // indirect
@@ -20,6 +20,14 @@ func init() {
 	flag.BoolVar(&help, "help", false, "help message")
 	flag.StringVar(&config, "config", "", "json config file")
 	flag.StringVar(&bindaddr, "addr", "0.0.0.0:2080", "proxy service address")
+
+	// 证书及私钥, 可以是文件路径或PEM内容, 优先于环境变量及配置文件.
+	flag.StringVar(&wsproxy.CACert, "ca", "", "ca certificate file")
+	flag.StringVar(&wsproxy.ServerCert, "server-cert", "", "server certificate file")
+	flag.StringVar(&wsproxy.ServerKey, "server-key", "", "server private key file")
+	flag.StringVar(&wsproxy.ClientCert, "client-cert", "", "client certificate file")
+	flag.StringVar(&wsproxy.ClientKey, "client-key", "", "client private key file")
+	flag.StringVar(&wsproxy.CRL, "crl", "", "certificate revocation list file")
 }
 
 func proxyAuth(user, passwd string) bool {
@@ -36,6 +44,11 @@ func proxyAuth(user, passwd string) bool {
 }
 
 func main() {
+	// wsproxy cert 子命令用于创建ca及签发证书.
+	if len(os.Args) > 1 && os.Args[1] == "cert" {
+		os.Exit(certCommand(os.Args[2:]))
+	}
+
 	path, err := os.Getwd()
 	if err != nil {
 		log.Println(err)
@@ -53,7 +66,11 @@ func main() {
 		wsproxy.JSONConfig = config
 	}
 
-	server := wsproxy.NewServer(nil)
+	server, err := wsproxy.NewServer(nil)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	server.AuthHandleFunc(proxyAuth)
 
 	go server.Start(bindaddr)
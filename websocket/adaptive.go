@@ -0,0 +1,44 @@
+package websocket
+
+const (
+	// adaptiveSamples 每轮统计的压缩消息数.
+	adaptiveSamples = 32
+
+	// adaptiveRatio 一轮中压缩后的总长度超过原长度的该百分比时认为压缩没有效果.
+	adaptiveRatio = 90
+
+	// adaptiveSkip 压缩没有效果时暂停压缩的消息数, 之后重新采样.
+	adaptiveSkip = 256
+)
+
+// adaptive 按流统计压缩效果, 已加密等不可压缩的数据压缩后没有变小, 此时暂停压缩以节省CPU.
+type adaptive struct {
+	raw    int64
+	packed int64
+	count  int
+	skip   int
+}
+
+// enabled 返回下一个消息是否压缩.
+func (a *adaptive) enabled() bool {
+	if a.skip > 0 {
+		a.skip--
+		return false
+	}
+	return true
+}
+
+// record 记录一个消息压缩前后的长度, 每轮结束时决定是否暂停压缩.
+func (a *adaptive) record(raw, packed int) {
+	a.raw += int64(raw)
+	a.packed += int64(packed)
+	a.count++
+	if a.count < adaptiveSamples {
+		return
+	}
+
+	if a.packed*100 > a.raw*adaptiveRatio {
+		a.skip = adaptiveSkip
+	}
+	a.raw, a.packed, a.count = 0, 0, 0
+}
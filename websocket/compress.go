@@ -0,0 +1,283 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	lz4 "github.com/bkaradzic/go-lz4"
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 握手时可以协商的压缩方式.
+const (
+	CompressionDeflate = "deflate"
+	CompressionZstd    = "zstd"
+	CompressionLZ4     = "lz4"
+	CompressionSnappy  = "snappy"
+)
+
+// compressionExtensions 压缩方式在 Sec-WebSocket-Extensions 中的扩展名, deflate 使用标准的 permessage-deflate.
+var compressionExtensions = map[string]string{
+	CompressionDeflate: DeflateExtension,
+	CompressionZstd:    "x-wsproxy-zstd",
+	CompressionLZ4:     "x-wsproxy-lz4",
+	CompressionSnappy:  "x-wsproxy-snappy",
+}
+
+const (
+	// zstdWindowSize 压缩时使用的窗口, zstdMaxWindowSize 解压时允许的最大窗口.
+	zstdWindowSize    = 1 << 20
+	zstdMaxWindowSize = 8 << 20
+)
+
+// rsv1 压缩消息第一个帧的RSV1标记.
+var rsv1 = ws.Rsv(true, false, false)
+
+var errMessageTooBig = errors.New("websocket: message too big")
+
+// codec 消息压缩方式, compress 只在持有 wmu 时调用, decompress 只在读取消息的goroutine中调用.
+type codec interface {
+	// compress 压缩一个消息, 返回的数据在下一次压缩前有效.
+	compress(p []byte) ([]byte, error)
+
+	// decompress 解压一个消息, 解压后超过limit时返回 errMessageTooBig.
+	decompress(p []byte, limit int64) ([]byte, error)
+
+	// reset 丢弃压缩的上下文, 压缩后的消息没有发送时调用.
+	reset()
+}
+
+// CompressionOffer 按优先顺序生成客户端握手时请求的压缩扩展.
+func CompressionOffer(names []string) ([]httphead.Option, error) {
+	var offers []httphead.Option
+	for _, name := range names {
+		ext, ok := compressionExtensions[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported compression %q", name)
+		}
+		offers = append(offers, httphead.NewOption(ext, nil))
+	}
+
+	return offers, nil
+}
+
+// NegotiateCompression 按客户端请求的顺序选择第一个支持的压缩方式, 返回名称及 permessage-deflate 参数,
+// 没有支持的压缩方式时返回空字符串, 连接不压缩.
+func NegotiateCompression(extensions []string) (string, *DeflateParams) {
+	for _, v := range extensions {
+		offers, ok := httphead.ParseOptions([]byte(v), nil)
+		if !ok {
+			continue
+		}
+
+		for _, offer := range offers {
+			name := compressionName(string(offer.Name))
+			switch name {
+			case "":
+				continue
+			case CompressionDeflate:
+				if p, ok := acceptDeflate(offer); ok {
+					return name, p
+				}
+			default:
+				// 其它压缩方式没有参数.
+				if offer.Parameters.Size() == 0 {
+					return name, nil
+				}
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// CompressionResponse 返回服务端确认压缩方式时 Sec-WebSocket-Extensions 的值.
+func CompressionResponse(name string, deflate *DeflateParams) string {
+	if name == CompressionDeflate {
+		return deflate.String()
+	}
+	return compressionExtensions[name]
+}
+
+// ParseCompressionResponse 从握手成功后服务端确认的扩展中取出压缩方式, 服务端不支持请求的压缩方式时返回空字符串.
+func ParseCompressionResponse(extensions []httphead.Option) (string, *DeflateParams, error) {
+	for _, opt := range extensions {
+		switch name := compressionName(string(opt.Name)); name {
+		case "":
+			continue
+		case CompressionDeflate:
+			p, err := parseDeflateParams(opt, true)
+			return name, p, err
+		default:
+			return name, nil, nil
+		}
+	}
+
+	return "", nil, nil
+}
+
+func compressionName(ext string) string {
+	for name, v := range compressionExtensions {
+		if v == ext {
+			return name
+		}
+	}
+	return ""
+}
+
+// newCodec 创建协商的压缩方式, 没有协商压缩时返回nil.
+func newCodec(w *Websocket) codec {
+	switch w.Compression {
+	case CompressionDeflate:
+		params := w.Deflate
+		if params == nil {
+			params = &DeflateParams{}
+		}
+		return &deflateCodec{
+			params: params,
+			client: w.Client,
+			level:  w.level(),
+		}
+	case CompressionZstd:
+		return &zstdCodec{level: w.CompressionLevel}
+	case CompressionLZ4:
+		return &lz4Codec{}
+	case CompressionSnappy:
+		return &snappyCodec{}
+	}
+
+	return nil
+}
+
+// level 返回压缩级别, 为0时使用默认级别.
+func (w *Websocket) level() int {
+	if w.CompressionLevel == 0 {
+		return flate.DefaultCompression
+	}
+	return w.CompressionLevel
+}
+
+// readLimited 流式读取解压后的数据, 超过limit时返回 errMessageTooBig.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	var out bytes.Buffer
+	n, err := io.Copy(&out, io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > limit {
+		return nil, errMessageTooBig
+	}
+
+	return out.Bytes(), nil
+}
+
+// zstdCodec 每个消息是一个独立的zstd帧.
+type zstdCodec struct {
+	level int
+
+	enc *zstd.Encoder
+	buf []byte
+	dec *zstd.Decoder
+}
+
+// encoderLevel 把 compress/flate 的压缩级别对应到zstd的压缩级别.
+func (c *zstdCodec) encoderLevel() zstd.EncoderLevel {
+	switch {
+	case c.level == flate.HuffmanOnly:
+		return zstd.SpeedFastest
+	case c.level <= 0:
+		return zstd.SpeedDefault
+	}
+	return zstd.EncoderLevelFromZstd(c.level)
+}
+
+func (c *zstdCodec) compress(p []byte) ([]byte, error) {
+	if c.enc == nil {
+		enc, err := zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(c.encoderLevel()),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithWindowSize(zstdWindowSize))
+		if err != nil {
+			return nil, err
+		}
+		c.enc = enc
+	}
+
+	c.buf = c.enc.EncodeAll(p, c.buf[:0])
+	return c.buf, nil
+}
+
+func (c *zstdCodec) reset() {}
+
+func (c *zstdCodec) decompress(p []byte, limit int64) ([]byte, error) {
+	if c.dec == nil {
+		dec, err := zstd.NewReader(nil,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxWindow(zstdMaxWindowSize))
+		if err != nil {
+			return nil, err
+		}
+		c.dec = dec
+	}
+
+	if err := c.dec.Reset(bytes.NewReader(p)); err != nil {
+		return nil, err
+	}
+
+	return readLimited(c.dec, limit)
+}
+
+// lz4Codec 每个消息是一个lz4块, 前4个字节为解压后的长度.
+type lz4Codec struct {
+	buf []byte
+}
+
+func (c *lz4Codec) compress(p []byte) ([]byte, error) {
+	var err error
+	c.buf, err = lz4.Encode(c.buf[:cap(c.buf)], p)
+	return c.buf, err
+}
+
+func (c *lz4Codec) reset() {}
+
+func (c *lz4Codec) decompress(p []byte, limit int64) ([]byte, error) {
+	if len(p) < 4 {
+		return nil, lz4.ErrCorrupt
+	}
+	if int64(binary.LittleEndian.Uint32(p)) > limit {
+		return nil, errMessageTooBig
+	}
+
+	return lz4.Decode(nil, p)
+}
+
+// snappyCodec 每个消息是一个snappy块.
+type snappyCodec struct {
+	buf []byte
+}
+
+func (c *snappyCodec) compress(p []byte) ([]byte, error) {
+	c.buf = snappy.Encode(c.buf[:cap(c.buf)], p)
+	return c.buf, nil
+}
+
+func (c *snappyCodec) reset() {}
+
+func (c *snappyCodec) decompress(p []byte, limit int64) ([]byte, error) {
+	n, err := snappy.DecodedLen(p)
+	if err != nil {
+		return nil, err
+	}
+	if int64(n) > limit {
+		return nil, errMessageTooBig
+	}
+
+	return snappy.Decode(nil, p)
+}
@@ -0,0 +1,343 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// ErrPongTimeout 发送Ping后超时没有收到Pong, 连接已关闭.
+var ErrPongTimeout = errors.New("websocket: pong timeout")
+
+// Conn 把websocket消息流转换为字节流, 实现 net.Conn, 编码对调用方透明.
+type Conn struct {
+	// rtt 及 timedOut 使用原子操作访问, 放在最前面保证64位对齐.
+	rtt      int64
+	timedOut int32
+
+	ws   *Websocket
+	conn net.Conn
+
+	pong chan []byte
+	done chan struct{}
+
+	rmu  sync.Mutex
+	rbuf []byte
+	zr   io.ReadCloser
+
+	// 旧版本zlib编码的压缩器, 每个消息是一个独立的zlib流. 对方总是解压,
+	// 压缩没有效果时使用不压缩的存储块.
+	wmu      sync.Mutex
+	zw       *zlib.Writer
+	zs       *zlib.Writer
+	zbuf     bytes.Buffer
+	adaptive adaptive
+	written  int64
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewConn 在已完成握手的websocket上创建字节流, conn 为websocket所在的底层连接,
+// 用于关闭连接、设置超时及获取地址. NewConn 会设置 w.OnPong.
+func NewConn(conn net.Conn, w *Websocket) *Conn {
+	c := &Conn{
+		ws:   w,
+		conn: conn,
+		pong: make(chan []byte, 1),
+		done: make(chan struct{}),
+	}
+	w.OnPong = c.onPong
+
+	return c
+}
+
+func (c *Conn) onPong(payload []byte) {
+	select {
+	case c.pong <- payload:
+	default:
+	}
+}
+
+// KeepAlive 每隔interval发送一个Ping, 超过timeout没有收到对应的Pong时关闭连接,
+// 之后的Read返回 ErrPongTimeout. interval不大于0时不发送Ping, timeout不大于0时使用interval.
+func (c *Conn) KeepAlive(interval, timeout time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	if timeout <= 0 {
+		timeout = interval
+	}
+
+	go c.keepAlive(interval, timeout)
+}
+
+func (c *Conn) keepAlive(interval, timeout time.Duration) {
+	payload := make([]byte, 8)
+	for seq := uint64(1); ; seq++ {
+		select {
+		case <-c.done:
+			return
+		case <-time.After(interval):
+		}
+
+		binary.BigEndian.PutUint64(payload, seq)
+		sent := time.Now()
+		if err := c.ws.WriteMessage(ws.OpPing, payload); err != nil {
+			return
+		}
+
+		if !c.waitPong(payload, timeout) {
+			select {
+			case <-c.done:
+			default:
+				atomic.StoreInt32(&c.timedOut, 1)
+				c.Close()
+			}
+			return
+		}
+		atomic.StoreInt64(&c.rtt, int64(time.Since(sent)))
+	}
+}
+
+// waitPong 等待与payload对应的Pong, 忽略过期的Pong.
+func (c *Conn) waitPong(payload []byte, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case p := <-c.pong:
+			if bytes.Equal(p, payload) {
+				return true
+			}
+		case <-timer.C:
+			return false
+		case <-c.done:
+			return false
+		}
+	}
+}
+
+// TimedOut 返回连接是否因为没有收到Pong而关闭.
+func (c *Conn) TimedOut() bool {
+	return atomic.LoadInt32(&c.timedOut) != 0
+}
+
+// RTT 返回最近一次Ping/Pong测得的往返时间, 没有启用 KeepAlive 或还没有测得时返回0.
+func (c *Conn) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+// Websocket 返回字节流所在的websocket.
+func (c *Conn) Websocket() *Websocket {
+	return c.ws
+}
+
+// decode 解压旧版本zlib编码的消息, 与协商的压缩方式使用相同的长度及解压比例限制.
+func (c *Conn) decode(msg []byte) ([]byte, error) {
+	if c.ws.Encoding != "zlib" || len(msg) == 0 {
+		return msg, nil
+	}
+
+	return c.ws.inflate(msg, c.ws.maxInflationRatio(), c.zlibDecode)
+}
+
+func (c *Conn) zlibDecode(p []byte, limit int64) ([]byte, error) {
+	// 复用解压器, 避免每个消息重新分配.
+	src := bytes.NewReader(p)
+	if c.zr == nil {
+		r, err := zlib.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		c.zr = r
+	} else if err := c.zr.(zlib.Resetter).Reset(src, nil); err != nil {
+		return nil, err
+	}
+
+	return readLimited(c.zr, limit)
+}
+
+func (c *Conn) encode(p []byte) ([]byte, error) {
+	if c.ws.Encoding != "zlib" {
+		return p, nil
+	}
+
+	// 复用压缩器, 调用方持有 wmu, 返回的数据在下一次编码前有效.
+	if !c.ws.AlwaysCompress && !c.adaptive.enabled() {
+		return c.zlibEncode(&c.zs, zlib.NoCompression, p)
+	}
+
+	out, err := c.zlibEncode(&c.zw, c.ws.level(), p)
+	if err != nil {
+		return nil, err
+	}
+	if !c.ws.AlwaysCompress {
+		c.adaptive.record(len(p), len(out))
+	}
+
+	return out, nil
+}
+
+func (c *Conn) zlibEncode(zw **zlib.Writer, level int, p []byte) ([]byte, error) {
+	c.zbuf.Reset()
+	if *zw == nil {
+		w, err := zlib.NewWriterLevel(&c.zbuf, level)
+		if err != nil {
+			return nil, err
+		}
+		*zw = w
+	} else {
+		(*zw).Reset(&c.zbuf)
+	}
+
+	if _, err := (*zw).Write(p); err != nil {
+		return nil, err
+	}
+	if err := (*zw).Close(); err != nil {
+		return nil, err
+	}
+
+	return c.zbuf.Bytes(), nil
+}
+
+// Read 读取数据, 一次读取可以跨越多个消息的边界, 收到关闭帧时返回 io.EOF,
+// 收到文本消息时以1003状态码关闭.
+func (c *Conn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.rbuf) == 0 {
+		op, msg, err := c.ws.ReadMessage()
+		if err != nil {
+			if c.TimedOut() {
+				err = ErrPongTimeout
+			}
+			return 0, err
+		}
+		if op == ws.OpClose {
+			return 0, io.EOF
+		}
+		// 隧道中只传输二进制数据.
+		if op != ws.OpBinary {
+			return 0, c.ws.fail(ws.StatusUnsupportedData, "text message not supported")
+		}
+
+		c.rbuf, err = c.decode(msg)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+
+	return n, nil
+}
+
+// Write 把p作为二进制消息发送, 超过对方帧及消息长度限制的数据分成多个消息, 返回已发送的长度.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	size := c.maxWriteSize()
+	n := 0
+	for {
+		chunk := p
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+
+		msg, err := c.encode(chunk)
+		if err != nil {
+			return n, err
+		}
+		if err := c.ws.WriteMessage(ws.OpBinary, msg); err != nil {
+			return n, err
+		}
+		c.written += int64(len(chunk))
+		n += len(chunk)
+
+		p = p[len(chunk):]
+		if len(p) == 0 {
+			return n, nil
+		}
+	}
+}
+
+// maxWriteSize 返回一个消息最多携带的数据长度. 隧道两端使用相同的长度限制, 压缩或编码后不可压缩的数据会略微变长,
+// 因此在帧及消息长度限制之下留出余量.
+func (c *Conn) maxWriteSize() int {
+	limit := c.ws.maxFrameSize()
+	if m := c.ws.maxMessageSize(); m < limit {
+		limit = m
+	}
+
+	size := limit - limit/64 - 64
+	if size < limit/2 {
+		size = limit / 2
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	return int(size)
+}
+
+// WriteStats 返回写入的数据长度及编码、压缩后实际发送的消息长度.
+func (c *Conn) WriteStats() (written, sent int64) {
+	c.wmu.Lock()
+	written = c.written
+	c.wmu.Unlock()
+
+	return written, c.ws.Sent()
+}
+
+// Close 发送关闭帧后关闭底层连接.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		// 对方不再读取时关闭帧可能无法写出, 不能让关闭一直阻塞.
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.ws.WriteClose(ws.StatusNormalClosure, "")
+
+		c.closeErr = c.conn.Close()
+	})
+
+	return c.closeErr
+}
+
+// LocalAddr 返回底层连接的本地地址.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr 返回底层连接的远端地址.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline 设置底层连接的读写超时.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline 设置底层连接的读超时.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline 设置底层连接的写超时.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
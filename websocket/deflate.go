@@ -0,0 +1,210 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/gobwas/httphead"
+)
+
+const (
+	// DeflateExtension permessage-deflate 扩展名, 见 RFC 7692.
+	DeflateExtension = "permessage-deflate"
+
+	// maxWindowBits LZ77滑动窗口的最大位数, compress/flate 压缩时总是使用32K窗口.
+	maxWindowBits = 15
+	maxWindowSize = 1 << maxWindowBits
+)
+
+var (
+	// deflateTail 同步flush产生的结尾, 发送时去掉, 接收时补上.
+	deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+	// deflateFinal 一个空的结束块.
+	deflateFinal = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+)
+
+// DeflateParams permessage-deflate 协商的参数, 窗口位数为0时表示没有限制.
+type DeflateParams struct {
+	ServerNoContextTakeover bool
+	ClientNoContextTakeover bool
+	ServerMaxWindowBits     int
+	ClientMaxWindowBits     int
+}
+
+// String 返回 Sec-WebSocket-Extensions 中的扩展描述.
+func (p *DeflateParams) String() string {
+	s := DeflateExtension
+	if p.ServerNoContextTakeover {
+		s += "; server_no_context_takeover"
+	}
+	if p.ClientNoContextTakeover {
+		s += "; client_no_context_takeover"
+	}
+	if p.ServerMaxWindowBits > 0 {
+		s += "; server_max_window_bits=" + strconv.Itoa(p.ServerMaxWindowBits)
+	}
+	if p.ClientMaxWindowBits > 0 {
+		s += "; client_max_window_bits=" + strconv.Itoa(p.ClientMaxWindowBits)
+	}
+
+	return s
+}
+
+// acceptDeflate 检查客户端的 permessage-deflate 请求, 返回服务端回复的参数, 不能接受时返回false.
+func acceptDeflate(offer httphead.Option) (*DeflateParams, bool) {
+	p, err := parseDeflateParams(offer, false)
+	if err != nil {
+		return nil, false
+	}
+
+	// 压缩时不能限制窗口大小, 客户端限制了服务端窗口时不接受.
+	if p.ServerMaxWindowBits > 0 && p.ServerMaxWindowBits < maxWindowBits {
+		return nil, false
+	}
+
+	// 客户端窗口不需要限制, 解压时支持任意窗口大小.
+	p.ClientMaxWindowBits = 0
+
+	return p, true
+}
+
+// parseDeflateParams 解析 permessage-deflate 请求或回复中的参数.
+func parseDeflateParams(opt httphead.Option, response bool) (*DeflateParams, error) {
+	p := &DeflateParams{}
+	seen := make(map[string]bool)
+
+	var err error
+	opt.Parameters.ForEach(func(k, v []byte) bool {
+		key := string(k)
+		if seen[key] {
+			err = fmt.Errorf("duplicate %s parameter %s", DeflateExtension, key)
+			return false
+		}
+		seen[key] = true
+
+		switch key {
+		case "server_no_context_takeover":
+			p.ServerNoContextTakeover = true
+		case "client_no_context_takeover":
+			p.ClientNoContextTakeover = true
+		case "server_max_window_bits":
+			p.ServerMaxWindowBits, err = parseWindowBits(v, false)
+		case "client_max_window_bits":
+			// 客户端请求中可以不带值, 表示支持服务端限制客户端窗口.
+			p.ClientMaxWindowBits, err = parseWindowBits(v, !response)
+		default:
+			err = fmt.Errorf("unknown %s parameter %s", DeflateExtension, key)
+		}
+
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func parseWindowBits(v []byte, optional bool) (int, error) {
+	if len(v) == 0 && optional {
+		return 0, nil
+	}
+
+	bits, err := strconv.Atoi(strings.Trim(string(v), `"`))
+	if err != nil || bits < 8 || bits > maxWindowBits {
+		return 0, fmt.Errorf("invalid window bits %q", v)
+	}
+
+	return bits, nil
+}
+
+// deflateCodec permessage-deflate 压缩, 每个方向使用一个持续的压缩器.
+type deflateCodec struct {
+	params *DeflateParams
+	client bool
+	level  int
+
+	fw   *flate.Writer
+	fbuf bytes.Buffer
+
+	// 对方使用上下文时以之前解压的数据作为字典.
+	fr   io.ReadCloser
+	dict []byte
+}
+
+// takeover 返回本端压缩时是否可以使用之前消息的上下文.
+func (c *deflateCodec) takeover() bool {
+	if c.client {
+		return !c.params.ClientNoContextTakeover
+	}
+	return !c.params.ServerNoContextTakeover
+}
+
+// peerTakeover 返回对方压缩时是否会使用之前消息的上下文.
+func (c *deflateCodec) peerTakeover() bool {
+	if c.client {
+		return !c.params.ServerNoContextTakeover
+	}
+	return !c.params.ClientNoContextTakeover
+}
+
+// compress 每个消息以同步flush结束. 协商允许时压缩器在消息之间保留上下文,
+// 之前发送的数据作为后续消息的字典.
+func (c *deflateCodec) compress(p []byte) ([]byte, error) {
+	c.fbuf.Reset()
+	if c.fw == nil {
+		fw, err := flate.NewWriter(&c.fbuf, c.level)
+		if err != nil {
+			return nil, err
+		}
+		c.fw = fw
+	} else if !c.takeover() {
+		c.fw.Reset(&c.fbuf)
+	}
+
+	if _, err := c.fw.Write(p); err != nil {
+		return nil, err
+	}
+	if err := c.fw.Flush(); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(c.fbuf.Bytes(), deflateTail), nil
+}
+
+func (c *deflateCodec) reset() {
+	if c.fw != nil {
+		c.fw.Reset(&c.fbuf)
+	}
+}
+
+func (c *deflateCodec) decompress(p []byte, limit int64) ([]byte, error) {
+	// 补上同步flush的结尾及一个空的结束块, 解压器读完数据后返回 io.EOF.
+	src := io.MultiReader(bytes.NewReader(p), bytes.NewReader(deflateTail),
+		bytes.NewReader(deflateFinal))
+	if c.fr == nil {
+		c.fr = flate.NewReaderDict(src, c.dict)
+	} else if err := c.fr.(flate.Resetter).Reset(src, c.dict); err != nil {
+		return nil, err
+	}
+
+	msg, err := readLimited(c.fr, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.peerTakeover() {
+		dict := append(c.dict, msg...)
+		if len(dict) > maxWindowSize {
+			dict = dict[len(dict)-maxWindowSize:]
+		}
+		c.dict = append([]byte(nil), dict...)
+	}
+
+	return msg, nil
+}
@@ -1,8 +1,16 @@
 package websocket
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
 
+	"github.com/gobwas/httphead"
 	"github.com/gobwas/ws"
 )
 
@@ -10,19 +18,84 @@ import (
 type Websocket struct {
 	Conn     *io.ReadWriter
 	Encoding string
+
+	// URI 及 Header 为握手请求的地址和头部.
+	URI    string
+	Header http.Header
+
+	// MaxFrameSize 及 MaxMessageSize 为接收的帧及消息的最大长度, 为0时使用默认值, 超过时以1009状态码关闭.
+	MaxFrameSize   int64
+	MaxMessageSize int64
+
+	// OnPong 收到Pong时在读取消息的goroutine中调用.
+	OnPong func(payload []byte)
+
+	// Client 为true时作为客户端使用, 发送的帧需要掩码, 接收的帧不能有掩码.
+	Client bool
+
+	// Compression 为握手时协商的压缩方式, 为空时不压缩.
+	Compression string
+
+	// Deflate 为协商的 permessage-deflate 参数, 只在 Compression 为 CompressionDeflate 时使用.
+	Deflate *DeflateParams
+
+	// CompressionLevel 压缩级别, 与 compress/flate 相同, 为0时使用默认级别.
+	CompressionLevel int
+
+	// MaxInflationRatio 压缩消息解压后与压缩前长度的最大比例, 为0时使用默认值, 小于0时只限制最大消息长度,
+	// 超过时以1009状态码关闭, 用于防止压缩炸弹. zstd 的压缩比远超deflate, 不按比例限制, 只受最大消息长度限制.
+	MaxInflationRatio int
+
+	// AlwaysCompress 为true时压缩所有数据消息, 否则按压缩效果自适应, 不可压缩的数据原样发送.
+	AlwaysCompress bool
+
+	wmu    sync.Mutex
+	closed bool
+	sent   int64
+
+	// 压缩器及解压器在第一次使用时按协商的压缩方式创建.
+	codecOnce sync.Once
+	codec     codec
+	adaptive  adaptive
+
+	// failure 检测到错误关闭连接时的 *CloseError.
+	failure atomic.Value
 }
 
 // NewWebsocket ...
 func NewWebsocket(conn io.ReadWriter) (*Websocket, error) {
 	encoding := ""
+	uri := ""
+	header := http.Header{}
+	var extensions []string
+	var compression string
+	var deflate *DeflateParams
 
 	u := ws.Upgrader{
+		OnRequest: func(b []byte) (err error) {
+			uri = string(b)
+			return
+		},
 		OnHeader: func(key, value []byte) (err error) {
 			if string(key) == "Content-Encoding" {
 				encoding = string(value)
 			}
+			header.Add(string(key), string(value))
 			return
 		},
+		ExtensionCustom: func(v []byte, exts []httphead.Option) ([]httphead.Option, bool) {
+			extensions = append(extensions, string(v))
+			return exts, true
+		},
+		OnBeforeUpgrade: func() (ws.HandshakeHeader, error) {
+			// 确认协商的压缩方式.
+			compression, deflate = NegotiateCompression(extensions)
+			if compression == "" {
+				return nil, nil
+			}
+			return ws.HandshakeHeaderString("Sec-WebSocket-Extensions: " +
+				CompressionResponse(compression, deflate) + "\r\n"), nil
+		},
 	}
 	_, err := u.Upgrade(conn)
 	if err != nil {
@@ -32,34 +105,330 @@ func NewWebsocket(conn io.ReadWriter) (*Websocket, error) {
 	return &Websocket{
 		Conn:     &conn,
 		Encoding: encoding,
+		URI:      uri,
+		Header:   header,
+
+		Compression: compression,
+		Deflate:     deflate,
 	}, nil
 }
 
-// ReadMessage ...
-func (w *Websocket) ReadMessage() (op ws.OpCode, p []byte, err error) {
-	header, err := ws.ReadHeader(*w.Conn)
-	if err != nil {
-		return 0, nil, err
+const (
+	// DefaultMaxFrameSize 默认的最大帧长度.
+	DefaultMaxFrameSize = 1 << 20
+
+	// DefaultMaxMessageSize 默认的最大消息长度.
+	DefaultMaxMessageSize = 4 << 20
+
+	// DefaultMaxInflationRatio 默认的最大解压比例, 约为deflate的理论上限.
+	DefaultMaxInflationRatio = 1024
+
+	// minInflationLimit 小消息解压后允许的最小长度, 避免上下文中的重复数据按比例被误判.
+	minInflationLimit = 64 << 10
+)
+
+// ErrClosed 已发送关闭帧后不能再发送数据.
+var ErrClosed = errors.New("websocket: close frame sent")
+
+// CloseError 检测到协议错误时关闭连接使用的状态码及原因.
+type CloseError struct {
+	Code   ws.StatusCode
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Reason)
+}
+
+// state 返回检查帧头时使用的状态.
+func (w *Websocket) state() ws.State {
+	// 旧版本客户端发送的帧没有掩码, 服务端不要求掩码以保持兼容.
+	state := ws.State(0)
+	if w.Client {
+		state = ws.StateClientSide
+	}
+	if w.Compression != "" {
+		state = state.Set(ws.StateExtended)
+	}
+
+	return state
+}
+
+// fail 发送带状态码的关闭帧, 返回对应的错误.
+func (w *Websocket) fail(code ws.StatusCode, reason string) error {
+	err := &CloseError{Code: code, Reason: reason}
+	if w.Failure() == nil {
+		w.failure.Store(err)
 	}
+	w.WriteClose(code, reason)
+	return err
+}
+
+// Failure 返回本端检测到错误关闭连接时的状态码及原因, 没有时返回nil.
+func (w *Websocket) Failure() *CloseError {
+	err, _ := w.failure.Load().(*CloseError)
+	return err
+}
+
+func (w *Websocket) maxFrameSize() int64 {
+	if w.MaxFrameSize > 0 {
+		return w.MaxFrameSize
+	}
+	return DefaultMaxFrameSize
+}
 
-	payload := make([]byte, header.Length)
-	_, err = io.ReadFull(*w.Conn, payload)
+func (w *Websocket) maxMessageSize() int64 {
+	if w.MaxMessageSize > 0 {
+		return w.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+// readPayload 读取帧数据追加到buf, 缓冲区按实际收到的数据增长, 不按帧头声明的长度一次分配.
+func (w *Websocket) readPayload(buf *bytes.Buffer, header ws.Header) error {
+	start := buf.Len()
+	n, err := io.CopyN(buf, *w.Conn, header.Length)
 	if err != nil {
-		return 0, nil, err
+		if err == io.EOF && n < header.Length {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
 	}
 	if header.Masked {
-		ws.Cipher(payload, header.Mask, 0)
+		ws.Cipher(buf.Bytes()[start:], header.Mask, 0)
+	}
+
+	return nil
+}
+
+// ReadMessage 读取一个完整的消息, 合并分片帧, 自动回复Ping, 解压压缩的消息.
+// 收到关闭帧时回复关闭帧并返回 ws.OpClose, 检测到协议错误或超过长度限制时发送对应状态码的关闭帧并返回 *CloseError.
+func (w *Websocket) ReadMessage() (op ws.OpCode, p []byte, err error) {
+	state := w.state()
+	var msg bytes.Buffer
+	compressed := false
+
+	for {
+		header, err := ws.ReadHeader(*w.Conn)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if err := ws.CheckHeader(header, state); err != nil {
+			return 0, nil, w.fail(ws.StatusProtocolError, err.Error())
+		}
+		// 压缩只使用RSV1, 且只能出现在数据消息的第一个帧.
+		if header.Rsv&^rsv1 != 0 || header.Rsv1() &&
+			(header.OpCode.IsControl() || header.OpCode == ws.OpContinuation) {
+			return 0, nil, w.fail(ws.StatusProtocolError, "invalid rsv bits")
+		}
+		if header.Length > w.maxFrameSize() {
+			return 0, nil, w.fail(ws.StatusMessageTooBig, "frame too big")
+		}
+
+		// 控制帧不超过125字节, 可以在分片消息中间出现.
+		if header.OpCode.IsControl() {
+			var control bytes.Buffer
+			if err := w.readPayload(&control, header); err != nil {
+				return 0, nil, err
+			}
+			payload := control.Bytes()
+
+			switch header.OpCode {
+			case ws.OpPing:
+				if err := w.WriteMessage(ws.OpPong, payload); err != nil && err != ErrClosed {
+					return 0, nil, err
+				}
+			case ws.OpPong:
+				if w.OnPong != nil {
+					w.OnPong(payload)
+				}
+			case ws.OpClose:
+				return ws.OpClose, payload, w.readClose(payload)
+			}
+			continue
+		}
+
+		if int64(msg.Len())+header.Length > w.maxMessageSize() {
+			return 0, nil, w.fail(ws.StatusMessageTooBig, "message too big")
+		}
+		if header.OpCode != ws.OpContinuation {
+			op = header.OpCode
+			compressed = header.Rsv1()
+		}
+		if err := w.readPayload(&msg, header); err != nil {
+			return 0, nil, err
+		}
+
+		if !header.Fin {
+			state = state.Set(ws.StateFragmented)
+			continue
+		}
+
+		p = msg.Bytes()
+		if compressed {
+			if p, err = w.decompress(p); err != nil {
+				return 0, nil, err
+			}
+		}
+		if op == ws.OpText && !utf8.Valid(p) {
+			return 0, nil, w.fail(ws.StatusInvalidFramePayloadData, "invalid utf8 text message")
+		}
+
+		return op, p, nil
+	}
+}
+
+// readClose 检查对方的关闭帧并回复相同的状态码.
+func (w *Websocket) readClose(payload []byte) error {
+	if len(payload) == 0 {
+		w.WriteMessage(ws.OpClose, nil)
+		return nil
+	}
+	if len(payload) < 2 {
+		return w.fail(ws.StatusProtocolError, "invalid close frame")
+	}
+
+	code, reason := ws.ParseCloseFrameData(payload)
+	if err := ws.CheckCloseFrameData(code, reason); err != nil {
+		if err == ws.ErrProtocolInvalidUTF8 {
+			return w.fail(ws.StatusInvalidFramePayloadData, err.Error())
+		}
+		return w.fail(ws.StatusProtocolError, err.Error())
 	}
 
-	return header.OpCode, payload, err
+	w.WriteClose(code, "")
+	return nil
 }
 
-// WriteMessage ...
+// WriteMessage 发送一个不分片的消息, 客户端发送的帧使用掩码, 已协商压缩时压缩数据消息,
+// 压缩后没有变小的消息不设置RSV1, 原样发送,
+// 可以在多个goroutine中调用.
 func (w *Websocket) WriteMessage(op ws.OpCode, data []byte) error {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+	if op == ws.OpClose {
+		w.closed = true
+	}
+
+	compressed := false
+	if w.Compression != "" && op.IsData() {
+		var err error
+		if data, compressed, err = w.compress(data); err != nil {
+			return err
+		}
+	}
+	if op.IsData() {
+		w.sent += int64(len(data))
+	}
+
 	f := ws.NewFrame(op, true, data)
+	if compressed {
+		f.Header.Rsv = rsv1
+	}
+	if w.Client {
+		f = ws.MaskFrame(f)
+	}
 	if err := ws.WriteFrame(*w.Conn, f); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// WriteClose 发送带状态码的关闭帧, 只发送一次.
+func (w *Websocket) WriteClose(code ws.StatusCode, reason string) error {
+	return w.WriteMessage(ws.OpClose, ws.NewCloseFrameBody(code, reason))
+}
+
+func (w *Websocket) getCodec() codec {
+	w.codecOnce.Do(func() {
+		w.codec = newCodec(w)
+	})
+	return w.codec
+}
+
+// decompress 解压一个协商压缩的消息.
+func (w *Websocket) decompress(p []byte) ([]byte, error) {
+	ratio := w.maxInflationRatio()
+	if w.Compression == CompressionZstd {
+		// 全零页、重复的JSON/HTML等正常数据经zstd压缩后比例可以远超1024, 按比例限制会误判.
+		ratio = 0
+	}
+
+	return w.inflate(p, ratio, w.getCodec().decompress)
+}
+
+// inflate 以流式解压一个消息, 解压后的长度受最大消息长度及最大解压比例ratio限制, ratio不大于0时只限制长度,
+// 超过时以1009状态码关闭, 数据错误时以1007状态码关闭, 不返回部分数据.
+func (w *Websocket) inflate(p []byte, ratio int64,
+	decompress func(p []byte, limit int64) ([]byte, error)) ([]byte, error) {
+	limit := w.maxMessageSize()
+	byRatio := false
+	if ratio > 0 {
+		n := int64(len(p)) * ratio
+		if n < minInflationLimit {
+			n = minInflationLimit
+		}
+		if n < limit {
+			limit = n
+			byRatio = true
+		}
+	}
+
+	msg, err := decompress(p, limit)
+	switch {
+	case err == errMessageTooBig && byRatio:
+		return nil, w.fail(ws.StatusMessageTooBig, "inflation ratio exceeded")
+	case err == errMessageTooBig:
+		return nil, w.fail(ws.StatusMessageTooBig, "message too big")
+	case err != nil:
+		return nil, w.fail(ws.StatusInvalidFramePayloadData, "invalid compressed data: "+err.Error())
+	}
+
+	return msg, nil
+}
+
+func (w *Websocket) maxInflationRatio() int64 {
+	if w.MaxInflationRatio == 0 {
+		return DefaultMaxInflationRatio
+	}
+	return int64(w.MaxInflationRatio)
+}
+
+// compress 压缩一个数据消息, 返回是否压缩. 调用方持有 wmu.
+func (w *Websocket) compress(p []byte) ([]byte, bool, error) {
+	if !w.AlwaysCompress && !w.adaptive.enabled() {
+		return p, false, nil
+	}
+
+	c := w.getCodec()
+	out, err := c.compress(p)
+	if err != nil {
+		return nil, false, err
+	}
+	if w.AlwaysCompress {
+		return out, true, nil
+	}
+
+	w.adaptive.record(len(p), len(out))
+	if len(out) >= len(p) {
+		// 对方没有收到这些数据, 压缩器不能再引用.
+		c.reset()
+		return p, false, nil
+	}
+
+	return out, true, nil
+}
+
+// Sent 返回已发送的数据消息长度, 为压缩后实际发送的长度.
+func (w *Websocket) Sent() int64 {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+
+	return w.sent
+}
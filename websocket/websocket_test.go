@@ -0,0 +1,765 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+)
+
+// tcpPipe 返回一对本机tcp连接, 与 net.Pipe 不同, 写入不需要等待对方读取, 关闭帧不会阻塞.
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return client, server
+}
+
+// newWebsocket 在conn上创建websocket, 用于测试时省略握手.
+func newWebsocket(conn net.Conn, client bool) *Websocket {
+	var rw io.ReadWriter = conn
+	return &Websocket{Conn: &rw, Client: client}
+}
+
+// wsPipe 返回一对已连接的客户端及服务端websocket, setup 同时用于两端, 可以为nil.
+func wsPipe(t *testing.T, setup func(w *Websocket)) (client, server *Websocket) {
+	cc, sc := tcpPipe(t)
+	client = newWebsocket(cc, true)
+	server = newWebsocket(sc, false)
+	if setup != nil {
+		setup(client)
+		setup(server)
+	}
+
+	return client, server
+}
+
+// exchange 在另一个goroutine中由from发送消息, 返回to读取的结果.
+func exchange(t *testing.T, from, to *Websocket, msg []byte) (ws.OpCode, []byte, error) {
+	t.Helper()
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- from.WriteMessage(ws.OpBinary, msg)
+	}()
+
+	op, p, err := to.ReadMessage()
+	if werr := <-sent; werr != nil {
+		t.Fatalf("WriteMessage: %v", werr)
+	}
+
+	return op, p, err
+}
+
+func randomBytes(n int) []byte {
+	p := make([]byte, n)
+	rand.Read(p)
+	return p
+}
+
+// testPayloads 可压缩及不可压缩的数据, 全零及重复的JSON压缩比远超deflate.
+func testPayloads() map[string][]byte {
+	return map[string][]byte{
+		"zeros":  make([]byte, 128<<10),
+		"json":   bytes.Repeat([]byte(`{"id":1,"name":"wsproxy","tags":["a","b"]},`), 20000),
+		"random": randomBytes(64 << 10),
+		"small":  []byte("hello"),
+	}
+}
+
+var compressions = []string{"", CompressionDeflate, CompressionZstd, CompressionLZ4, CompressionSnappy}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, compression := range compressions {
+		for _, always := range []bool{false, true} {
+			compression, always := compression, always
+			name := compression
+			if name == "" {
+				name = "none"
+			}
+			if always {
+				name += "/always"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				client, server := wsPipe(t, func(w *Websocket) {
+					w.Compression = compression
+					w.AlwaysCompress = always
+				})
+
+				for kind, payload := range testPayloads() {
+					// 两个方向各发送两次, 第二次使用压缩上下文.
+					for i := 0; i < 2; i++ {
+						for _, dir := range [][2]*Websocket{{client, server}, {server, client}} {
+							op, p, err := exchange(t, dir[0], dir[1], payload)
+							if err != nil {
+								t.Fatalf("%s: ReadMessage: %v", kind, err)
+							}
+							if op != ws.OpBinary || !bytes.Equal(p, payload) {
+								t.Fatalf("%s: got op %v and %d bytes, want %d bytes", kind, op, len(p), len(payload))
+							}
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestZlibRoundTrip 旧版本zlib编码通过 Conn 编解码.
+func TestZlibRoundTrip(t *testing.T) {
+	cc, sc := tcpPipe(t)
+	client := newWebsocket(cc, true)
+	server := newWebsocket(sc, false)
+	client.Encoding, server.Encoding = "zlib", "zlib"
+	c, s := NewConn(cc, client), NewConn(sc, server)
+
+	for kind, payload := range testPayloads() {
+		go c.Write(payload)
+
+		got := make([]byte, len(payload))
+		if _, err := io.ReadFull(s, got); err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("%s: data mismatch", kind)
+		}
+	}
+}
+
+// closeError 返回err中的 *CloseError.
+func closeError(t *testing.T, err error) *CloseError {
+	t.Helper()
+
+	var ce *CloseError
+	if !errors.As(err, &ce) {
+		t.Fatalf("error = %v, want *CloseError", err)
+	}
+	return ce
+}
+
+func TestInflationLimit(t *testing.T) {
+	zeros := make([]byte, 256<<10)
+
+	tests := []struct {
+		name        string
+		compression string
+		ratio       int
+		maxMessage  int64
+		code        ws.StatusCode
+		reason      string
+	}{
+		{"deflate ratio", CompressionDeflate, 2, 0, ws.StatusMessageTooBig, "inflation ratio exceeded"},
+		{"deflate size", CompressionDeflate, -1, 128 << 10, ws.StatusMessageTooBig, "message too big"},
+		{"lz4 size", CompressionLZ4, -1, 128 << 10, ws.StatusMessageTooBig, "message too big"},
+		{"snappy size", CompressionSnappy, -1, 128 << 10, ws.StatusMessageTooBig, "message too big"},
+		{"zstd size", CompressionZstd, 0, 128 << 10, ws.StatusMessageTooBig, "message too big"},
+		// zstd 不按比例限制.
+		{"zstd ratio", CompressionZstd, 2, 0, 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := wsPipe(t, func(w *Websocket) {
+				w.Compression = tt.compression
+				w.AlwaysCompress = true
+			})
+			server.MaxInflationRatio = tt.ratio
+			server.MaxMessageSize = tt.maxMessage
+
+			_, p, err := exchange(t, client, server, zeros)
+			if tt.code == 0 {
+				if err != nil || !bytes.Equal(p, zeros) {
+					t.Fatalf("ReadMessage = %d bytes, %v", len(p), err)
+				}
+				return
+			}
+
+			ce := closeError(t, err)
+			if ce.Code != tt.code || ce.Reason != tt.reason {
+				t.Fatalf("close %d %q, want %d %q", ce.Code, ce.Reason, tt.code, tt.reason)
+			}
+
+			// 对方收到带状态码的关闭帧.
+			op, payload, _ := client.ReadMessage()
+			code, _ := ws.ParseCloseFrameData(payload)
+			if op != ws.OpClose || code != tt.code {
+				t.Fatalf("peer got op %v code %d, want close %d", op, code, tt.code)
+			}
+		})
+	}
+}
+
+func TestInvalidCompressedData(t *testing.T) {
+	for _, compression := range compressions[1:] {
+		t.Run(compression, func(t *testing.T) {
+			cc, sc := tcpPipe(t)
+			server := newWebsocket(sc, false)
+			server.Compression = compression
+
+			// 设置了RSV1但不是有效的压缩数据, 开头声明的解压长度(lz4、snappy)为16字节.
+			f := ws.MaskFrame(ws.NewFrame(ws.OpBinary, true, []byte("\x10\x00\x00\x00"+strings.Repeat("\xff", 60))))
+			f.Header.Rsv = rsv1
+			go ws.WriteFrame(cc, f)
+
+			_, _, err := server.ReadMessage()
+			if ce := closeError(t, err); ce.Code != ws.StatusInvalidFramePayloadData {
+				t.Fatalf("close %d %q, want 1007", ce.Code, ce.Reason)
+			}
+		})
+	}
+}
+
+// connPipe 返回一对已连接的 Conn, setup 同时用于两端的websocket, 可以为nil.
+func connPipe(t *testing.T, setup func(w *Websocket)) (client, server *Conn) {
+	cc, sc := tcpPipe(t)
+	cw, sw := newWebsocket(cc, true), newWebsocket(sc, false)
+	if setup != nil {
+		setup(cw)
+		setup(sw)
+	}
+
+	return NewConn(cc, cw), NewConn(sc, sw)
+}
+
+// TestConnLargeWrite 超过帧及消息长度限制的写入分成多个消息, 对方按字节流完整读出.
+func TestConnLargeWrite(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(w *Websocket)
+	}{
+		{"default", nil},
+		{"small frames", func(w *Websocket) {
+			w.MaxFrameSize = 4096
+		}},
+		{"lz4 always", func(w *Websocket) {
+			w.MaxFrameSize = 4096
+			w.Compression = CompressionLZ4
+			w.AlwaysCompress = true
+		}},
+		{"zlib", func(w *Websocket) {
+			w.MaxFrameSize = 4096
+			w.Encoding = "zlib"
+			w.AlwaysCompress = true
+		}},
+	}
+
+	payload := randomBytes(DefaultMaxMessageSize + 12345)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := connPipe(t, tt.setup)
+
+			type result struct {
+				n   int
+				err error
+			}
+			done := make(chan result, 1)
+			go func() {
+				n, err := client.Write(payload)
+				done <- result{n, err}
+			}()
+
+			got := make([]byte, len(payload))
+			if _, err := io.ReadFull(server, got); err != nil {
+				t.Fatalf("ReadFull: %v", err)
+			}
+			if r := <-done; r.err != nil || r.n != len(payload) {
+				t.Fatalf("Write = %d, %v, want %d", r.n, r.err, len(payload))
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatal("data mismatch")
+			}
+
+			// io.Copy 同样不受长度限制.
+			go func() {
+				io.Copy(server, bytes.NewReader(payload))
+				server.Close()
+			}()
+			got, err := io.ReadAll(client)
+			if err != nil || !bytes.Equal(got, payload) {
+				t.Fatalf("io.Copy: %d bytes, %v", len(got), err)
+			}
+		})
+	}
+}
+
+// writeFrame 发送一个原始帧, 用于构造分片消息及协议错误.
+func writeFrame(t *testing.T, conn net.Conn, fin bool, op ws.OpCode, payload []byte, masked bool) {
+	t.Helper()
+
+	f := ws.NewFrame(op, fin, payload)
+	if masked {
+		f = ws.MaskFrame(f)
+	}
+	if err := ws.WriteFrame(conn, f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readCloseCode 读取对方发送的帧直到关闭帧, 返回其中的状态码.
+func readCloseCode(t *testing.T, conn net.Conn) ws.StatusCode {
+	t.Helper()
+
+	for {
+		f, err := ws.ReadFrame(conn)
+		if err != nil {
+			t.Fatalf("read close frame: %v", err)
+		}
+		if f.Header.OpCode == ws.OpClose {
+			if f.Header.Masked {
+				ws.Cipher(f.Payload, f.Header.Mask, 0)
+			}
+			code, _ := ws.ParseCloseFrameData(f.Payload)
+			return code
+		}
+	}
+}
+
+func TestFragmentedMessage(t *testing.T) {
+	cc, sc := tcpPipe(t)
+	server := newWebsocket(sc, false)
+
+	// Ping可以出现在分片消息的中间, 服务端立即回复Pong.
+	writeFrame(t, cc, false, ws.OpBinary, []byte("hel"), true)
+	writeFrame(t, cc, true, ws.OpPing, []byte("p"), true)
+	writeFrame(t, cc, false, ws.OpContinuation, []byte("lo "), true)
+	writeFrame(t, cc, true, ws.OpContinuation, []byte("world"), true)
+
+	op, p, err := server.ReadMessage()
+	if err != nil || op != ws.OpBinary || string(p) != "hello world" {
+		t.Fatalf("ReadMessage = %v %q %v, want binary \"hello world\"", op, p, err)
+	}
+
+	f, err := ws.ReadFrame(cc)
+	if err != nil || f.Header.OpCode != ws.OpPong || string(f.Payload) != "p" || f.Header.Masked {
+		t.Fatalf("reply = %+v %q %v, want unmasked pong \"p\"", f.Header, f.Payload, err)
+	}
+
+	// 为兼容旧版本客户端, 服务端接受没有掩码的帧.
+	writeFrame(t, cc, true, ws.OpBinary, []byte("legacy"), false)
+	if _, p, err := server.ReadMessage(); err != nil || string(p) != "legacy" {
+		t.Fatalf("unmasked frame: %q %v", p, err)
+	}
+
+	// 正常关闭时回复相同的状态码.
+	writeFrame(t, cc, true, ws.OpClose, ws.NewCloseFrameBody(ws.StatusGoingAway, "bye"), true)
+	if op, _, err := server.ReadMessage(); op != ws.OpClose || err != nil {
+		t.Fatalf("close: %v %v", op, err)
+	}
+	if code := readCloseCode(t, cc); code != ws.StatusGoingAway {
+		t.Fatalf("close reply %d, want %d", code, ws.StatusGoingAway)
+	}
+	if err := server.WriteMessage(ws.OpBinary, []byte("late")); err != ErrClosed {
+		t.Fatalf("write after close = %v, want ErrClosed", err)
+	}
+}
+
+func TestProtocolViolation(t *testing.T) {
+	type frame struct {
+		fin     bool
+		op      ws.OpCode
+		payload []byte
+		rsv     byte
+	}
+
+	tests := []struct {
+		name   string
+		frames []frame
+		code   ws.StatusCode
+	}{
+		{"unexpected continuation", []frame{{true, ws.OpContinuation, []byte("x"), 0}}, ws.StatusProtocolError},
+		{"missing continuation", []frame{
+			{false, ws.OpBinary, []byte("a"), 0},
+			{true, ws.OpBinary, []byte("b"), 0},
+		}, ws.StatusProtocolError},
+		{"fragmented control", []frame{{false, ws.OpPing, nil, 0}}, ws.StatusProtocolError},
+		{"control too long", []frame{{true, ws.OpPing, make([]byte, 126), 0}}, ws.StatusProtocolError},
+		{"reserved opcode", []frame{{true, ws.OpCode(0x3), nil, 0}}, ws.StatusProtocolError},
+		{"rsv without extension", []frame{{true, ws.OpBinary, []byte("x"), 0x4}}, ws.StatusProtocolError},
+		{"invalid utf8", []frame{{true, ws.OpText, []byte{0xff, 0xfe}, 0}}, ws.StatusInvalidFramePayloadData},
+		{"short close", []frame{{true, ws.OpClose, []byte{0x03}, 0}}, ws.StatusProtocolError},
+		{"invalid close code", []frame{{true, ws.OpClose, ws.NewCloseFrameBody(1005, ""), 0}}, ws.StatusProtocolError},
+		{"invalid close reason", []frame{{true, ws.OpClose, append(ws.NewCloseFrameBody(1000, ""), 0xff), 0}},
+			ws.StatusInvalidFramePayloadData},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc, sc := tcpPipe(t)
+			server := newWebsocket(sc, false)
+
+			go func() {
+				for _, f := range tt.frames {
+					fr := ws.MaskFrame(ws.NewFrame(f.op, f.fin, f.payload))
+					fr.Header.Rsv = f.rsv
+					ws.WriteFrame(cc, fr)
+				}
+			}()
+
+			_, _, err := server.ReadMessage()
+			if ce := closeError(t, err); ce.Code != tt.code {
+				t.Fatalf("close %d %q, want %d", ce.Code, ce.Reason, tt.code)
+			}
+			if code := readCloseCode(t, cc); code != tt.code {
+				t.Fatalf("peer got close %d, want %d", code, tt.code)
+			}
+			if err := server.Failure(); err == nil || err.Code != tt.code {
+				t.Fatalf("Failure() = %v", err)
+			}
+		})
+	}
+}
+
+// TestClientRejectsMaskedFrame 服务端发送的帧不能有掩码.
+func TestClientRejectsMaskedFrame(t *testing.T) {
+	cc, sc := tcpPipe(t)
+	client := newWebsocket(cc, true)
+
+	go ws.WriteFrame(sc, ws.MaskFrame(ws.NewFrame(ws.OpBinary, true, []byte("x"))))
+
+	_, _, err := client.ReadMessage()
+	if ce := closeError(t, err); ce.Code != ws.StatusProtocolError {
+		t.Fatalf("close %d %q, want 1002", ce.Code, ce.Reason)
+	}
+	if code := readCloseCode(t, sc); code != ws.StatusProtocolError {
+		t.Fatalf("peer got close %d, want 1002", code)
+	}
+}
+
+// TestConnTextMessage 隧道中只传输二进制消息, 收到文本消息时以1003关闭.
+func TestConnTextMessage(t *testing.T) {
+	client, server := connPipe(t, nil)
+
+	go client.Websocket().WriteMessage(ws.OpText, []byte("text"))
+
+	_, err := server.Read(make([]byte, 16))
+	if ce := closeError(t, err); ce.Code != ws.StatusUnsupportedData {
+		t.Fatalf("close %d %q, want 1003", ce.Code, ce.Reason)
+	}
+	if _, err := client.Read(make([]byte, 16)); err != io.EOF {
+		t.Fatalf("peer Read = %v, want io.EOF", err)
+	}
+}
+
+func TestOversize(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		reason string
+	}{
+		{"frame", [][]byte{make([]byte, 2048)}, "frame too big"},
+		{"message", [][]byte{make([]byte, 1024), make([]byte, 1024), make([]byte, 1024), make([]byte, 1024),
+			make([]byte, 1)}, "message too big"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc, sc := tcpPipe(t)
+			server := newWebsocket(sc, false)
+			server.MaxFrameSize = 1024
+			server.MaxMessageSize = 4096
+
+			go func() {
+				for i, p := range tt.frames {
+					op := ws.OpBinary
+					if i > 0 {
+						op = ws.OpContinuation
+					}
+					ws.WriteFrame(cc, ws.MaskFrame(ws.NewFrame(op, i == len(tt.frames)-1, p)))
+				}
+			}()
+
+			_, _, err := server.ReadMessage()
+			ce := closeError(t, err)
+			if ce.Code != ws.StatusMessageTooBig || ce.Reason != tt.reason {
+				t.Fatalf("close %d %q, want 1009 %q", ce.Code, ce.Reason, tt.reason)
+			}
+			if code := readCloseCode(t, cc); code != ws.StatusMessageTooBig {
+				t.Fatalf("peer got close %d, want 1009", code)
+			}
+		})
+	}
+
+	// 刚好等于限制的消息可以正常接收.
+	client, server := wsPipe(t, func(w *Websocket) {
+		w.MaxFrameSize = 1024
+		w.MaxMessageSize = 1024
+	})
+	if _, p, err := exchange(t, client, server, make([]byte, 1024)); err != nil || len(p) != 1024 {
+		t.Fatalf("message at the limit: %d bytes, %v", len(p), err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	client, server := connPipe(t, nil)
+
+	// 对方读取时自动回复Pong, 测得往返时间.
+	go io.Copy(ioutil.Discard, server)
+	go io.Copy(ioutil.Discard, client)
+	client.KeepAlive(10*time.Millisecond, time.Second)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no rtt measured while the peer answers pings")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if client.TimedOut() {
+		t.Fatal("timed out while the peer answers pings")
+	}
+	client.Close()
+}
+
+func TestPongTimeout(t *testing.T) {
+	// 对方不读取数据, 因此不会回复Pong.
+	client, _ := connPipe(t, nil)
+	client.KeepAlive(10*time.Millisecond, 50*time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Read(make([]byte, 16))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != ErrPongTimeout {
+			t.Fatalf("Read = %v, want ErrPongTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection kept open without pongs")
+	}
+	if !client.TimedOut() {
+		t.Fatal("TimedOut() = false after the pong timeout")
+	}
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Fatal("Write succeeded after the pong timeout")
+	}
+}
+
+func TestNegotiateDeflate(t *testing.T) {
+	tests := []struct {
+		offer  string
+		name   string
+		params *DeflateParams
+	}{
+		{"permessage-deflate", CompressionDeflate, &DeflateParams{}},
+		{"permessage-deflate; client_max_window_bits", CompressionDeflate, &DeflateParams{}},
+		{"permessage-deflate; client_max_window_bits=10", CompressionDeflate, &DeflateParams{}},
+		{"permessage-deflate; server_no_context_takeover; client_no_context_takeover", CompressionDeflate,
+			&DeflateParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true}},
+		{"permessage-deflate; server_max_window_bits=15", CompressionDeflate,
+			&DeflateParams{ServerMaxWindowBits: 15}},
+		// 压缩时不能限制窗口, 选择下一个请求的压缩方式.
+		{"permessage-deflate; server_max_window_bits=10, x-wsproxy-lz4", CompressionLZ4, nil},
+		{"permessage-deflate; unknown=1", "", nil},
+		{"permessage-deflate; server_no_context_takeover; server_no_context_takeover", "", nil},
+		{"permessage-deflate; client_max_window_bits=16", "", nil},
+		{"x-unknown, x-wsproxy-snappy", CompressionSnappy, nil},
+		{"x-wsproxy-zstd; level=3", "", nil},
+	}
+
+	for _, tt := range tests {
+		name, params := NegotiateCompression([]string{tt.offer})
+		if name != tt.name || (params == nil) != (tt.params == nil) ||
+			(params != nil && *params != *tt.params) {
+			t.Errorf("NegotiateCompression(%q) = %q %+v, want %q %+v", tt.offer, name, params, tt.name, tt.params)
+			continue
+		}
+		if name == "" {
+			continue
+		}
+
+		// 客户端解析服务端的回复得到相同的参数.
+		resp := CompressionResponse(name, params)
+		opts, ok := httphead.ParseOptions([]byte(resp), nil)
+		if !ok {
+			t.Errorf("invalid response %q", resp)
+			continue
+		}
+		got, gotParams, err := ParseCompressionResponse(opts)
+		if err != nil || got != name || (params != nil && *gotParams != *params) {
+			t.Errorf("ParseCompressionResponse(%q) = %q %+v %v", resp, got, gotParams, err)
+		}
+	}
+}
+
+// TestDeflateContextTakeover 使用上下文时重复的消息引用之前的数据, 压缩后更小,
+// 协商不使用上下文时每个消息单独压缩, 两种情况都能正确解压.
+func TestDeflateContextTakeover(t *testing.T) {
+	var b bytes.Buffer
+	for i := 0; i < 64; i++ {
+		fmt.Fprintf(&b, `{"id":%d,"token":"%x"},`, i, randomBytes(16))
+	}
+	msg := b.Bytes()
+
+	for _, params := range []DeflateParams{
+		{},
+		{ServerNoContextTakeover: true},
+		{ClientNoContextTakeover: true},
+		{ServerNoContextTakeover: true, ClientNoContextTakeover: true},
+	} {
+		params := params
+		t.Run(params.String(), func(t *testing.T) {
+			for _, level := range []int{0, flate.BestSpeed, flate.BestCompression} {
+				client, server := wsPipe(t, func(w *Websocket) {
+					w.Compression = CompressionDeflate
+					w.Deflate = &params
+					w.CompressionLevel = level
+				})
+
+				check := func(from, to *Websocket, takeover bool) {
+					var sizes []int64
+					for i := 0; i < 3; i++ {
+						// 中间的随机数据不压缩, 压缩器丢弃其上下文后仍能正确解压后续消息.
+						if i == 2 {
+							if _, p, err := exchange(t, from, to, randomBytes(4096)); err != nil || len(p) != 4096 {
+								t.Fatalf("level %d: random message %d bytes, %v", level, len(p), err)
+							}
+						}
+
+						before := from.Sent()
+						_, p, err := exchange(t, from, to, msg)
+						if err != nil || !bytes.Equal(p, msg) {
+							t.Fatalf("level %d message %d: %d bytes, %v", level, i, len(p), err)
+						}
+						sizes = append(sizes, from.Sent()-before)
+					}
+
+					if takeover && sizes[1]*4 > sizes[0] {
+						t.Errorf("level %d: repeated message %d bytes, first %d, want context takeover",
+							level, sizes[1], sizes[0])
+					}
+					if !takeover && sizes[1] != sizes[0] {
+						t.Errorf("level %d: sizes %v, want independent messages", level, sizes)
+					}
+				}
+
+				check(client, server, !params.ClientNoContextTakeover)
+				check(server, client, !params.ServerNoContextTakeover)
+			}
+		})
+	}
+}
+
+// TestCompressionPreference 服务端按客户端请求的顺序选择压缩方式.
+func TestCompressionPreference(t *testing.T) {
+	tests := []struct {
+		offer []string
+		want  string
+	}{
+		{[]string{CompressionZstd, CompressionDeflate}, CompressionZstd},
+		{[]string{CompressionSnappy, CompressionLZ4, CompressionZstd}, CompressionSnappy},
+		{[]string{CompressionDeflate, CompressionZstd}, CompressionDeflate},
+		{nil, ""},
+	}
+
+	for _, tt := range tests {
+		offers, err := CompressionOffer(tt.offer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		httphead.WriteOptions(&b, offers)
+
+		if name, _ := NegotiateCompression([]string{b.String()}); name != tt.want {
+			t.Errorf("offer %q negotiated %q, want %q", b.String(), name, tt.want)
+		}
+	}
+
+	if _, err := CompressionOffer([]string{"brotli"}); err == nil {
+		t.Error("unsupported compression accepted")
+	}
+}
+
+// TestAdaptiveCycle 一轮采样压缩没有效果时暂停压缩 adaptiveSkip 个消息, 之后重新采样.
+func TestAdaptiveCycle(t *testing.T) {
+	client, server := wsPipe(t, func(w *Websocket) {
+		w.Compression = CompressionLZ4
+	})
+	text := bytes.Repeat([]byte("compressible "), 100)
+
+	// send 发送一个消息, 返回实际发送的长度.
+	send := func(msg []byte) int64 {
+		t.Helper()
+		before := client.Sent()
+		if _, p, err := exchange(t, client, server, msg); err != nil || !bytes.Equal(p, msg) {
+			t.Fatalf("round trip: %d bytes, %v", len(p), err)
+		}
+		return client.Sent() - before
+	}
+
+	// 可压缩的数据一直压缩.
+	for i := 0; i < adaptiveSamples*2; i++ {
+		if n := send(text); n >= int64(len(text)) {
+			t.Fatalf("compressible message %d sent %d bytes uncompressed", i, n)
+		}
+	}
+
+	for i := 0; i < adaptiveSamples; i++ {
+		send(randomBytes(1024))
+	}
+	if client.adaptive.skip != adaptiveSkip {
+		t.Fatalf("skip = %d after incompressible samples, want %d", client.adaptive.skip, adaptiveSkip)
+	}
+
+	// 暂停期间可压缩的数据也原样发送.
+	for i := 0; i < adaptiveSkip; i++ {
+		if n := send(text); n != int64(len(text)) {
+			t.Fatalf("message %d during skip sent %d bytes, want %d", i, n, len(text))
+		}
+	}
+
+	// 暂停结束后重新采样, 压缩恢复.
+	if n := send(text); n >= int64(len(text)) {
+		t.Fatalf("message after skip sent %d bytes uncompressed", n)
+	}
+
+	// AlwaysCompress 时不暂停.
+	client.AlwaysCompress = true
+	for i := 0; i < adaptiveSamples; i++ {
+		send(randomBytes(1024))
+	}
+	if n := send(text); n >= int64(len(text)) {
+		t.Fatalf("AlwaysCompress message sent %d bytes uncompressed", n)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package wsproxy
+
+import (
+	"syscall"
+)
+
+const bindToDeviceSupported = true
+
+// bindToDevice 通过 SO_BINDTODEVICE 把socket绑定到指定网卡.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		ce := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if ce != nil {
+			return ce
+		}
+		return err
+	}
+}
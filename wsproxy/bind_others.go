@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package wsproxy
+
+import (
+	"syscall"
+)
+
+// 其它平台不支持 SO_BINDTODEVICE, 使用网卡地址作为源地址.
+const bindToDeviceSupported = false
+
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,174 @@
+package wsproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 证书及私钥的默认路径, 相对于当前目录.
+const (
+	defaultCACert     = ".wsproxy/certs/ca.crt"
+	defaultServerCert = ".wsproxy/certs/server.crt"
+	defaultServerKey  = ".wsproxy/certs/server.key"
+	defaultClientCert = ".wsproxy/certs/client.crt"
+	defaultClientKey  = ".wsproxy/certs/client.key"
+	defaultCRL        = ".wsproxy/certs/ca.crl"
+)
+
+// 设置证书及私钥的环境变量.
+const (
+	envCACert     = "WSPROXY_CA_CERT"
+	envServerCert = "WSPROXY_SERVER_CERT"
+	envServerKey  = "WSPROXY_SERVER_KEY"
+	envClientCert = "WSPROXY_CLIENT_CERT"
+	envClientKey  = "WSPROXY_CLIENT_KEY"
+	envCRL        = "WSPROXY_CRL"
+)
+
+// CertsConfig 证书、私钥及吊销列表的位置, 每一项可以是文件路径或PEM内容, 路径中可以使用 ${VAR} 引用环境变量,
+// 相对路径相对于配置文件所在的目录.
+type CertsConfig struct {
+	CA         string `json:"CA"`
+	ServerCert string `json:"ServerCert"`
+	ServerKey  string `json:"ServerKey"`
+	ClientCert string `json:"ClientCert"`
+	ClientKey  string `json:"ClientKey"`
+	CRL        string `json:"CRL"`
+
+	// RequireClientCert 为true时remote server要求客户端证书由ca签发, 且不在吊销列表中.
+	// 与校验服务器证书的 VerifyClientCert 方向相反.
+	RequireClientCert bool `json:"RequireClientCert"`
+}
+
+var (
+	// certsConfig 配置文件中的证书位置, certsDir 为配置文件所在的目录, 由 NewServer 设置.
+	certsConfig CertsConfig
+	certsDir    string
+)
+
+// certSource 按命令行参数、环境变量、配置文件、默认路径的顺序选择证书位置.
+func certSource(override, env, configured, def string) string {
+	if override != "" {
+		return override
+	}
+	if v := os.Getenv(env); v != "" {
+		return v
+	}
+	if configured != "" {
+		if isPEM(configured) {
+			return configured
+		}
+		path := os.ExpandEnv(configured)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(certsDir, path)
+		}
+		return path
+	}
+	return def
+}
+
+// certSources 返回当前使用的证书位置.
+func certSources() CertsConfig {
+	return CertsConfig{
+		CA:         certSource(CACert, envCACert, certsConfig.CA, defaultCACert),
+		ServerCert: certSource(ServerCert, envServerCert, certsConfig.ServerCert, defaultServerCert),
+		ServerKey:  certSource(ServerKey, envServerKey, certsConfig.ServerKey, defaultServerKey),
+		ClientCert: certSource(ClientCert, envClientCert, certsConfig.ClientCert, defaultClientCert),
+		ClientKey:  certSource(ClientKey, envClientKey, certsConfig.ClientKey, defaultClientKey),
+		CRL:        certSource(CRL, envCRL, certsConfig.CRL, defaultCRL),
+	}
+}
+
+func isPEM(v string) bool {
+	return strings.Contains(v, "-----BEGIN ")
+}
+
+// readPEM 读取PEM内容, v 为PEM内容或文件路径.
+func readPEM(v string) ([]byte, error) {
+	if isPEM(v) {
+		return []byte(v), nil
+	}
+	return ioutil.ReadFile(os.ExpandEnv(v))
+}
+
+// loadCertPool 加载ca证书.
+func loadCertPool(ca string) (*x509.CertPool, error) {
+	pem, err := readPEM(ca)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", describeCert(ca))
+	}
+
+	return pool, nil
+}
+
+// loadKeyPair 加载证书及私钥.
+func loadKeyPair(cert, key string) (tls.Certificate, error) {
+	certPEM, err := readPEM(cert)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := readPEM(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// verifyNotRevoked 返回检查客户端证书是否被吊销的函数, 每次握手重新读取吊销列表, 吊销后不需要重启.
+// 吊销列表文件不存在时表示没有吊销的证书.
+func verifyNotRevoked(crl string) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, chains [][]*x509.Certificate) error {
+		data, err := readPEM(crl)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if block, _ := pem.Decode(data); block != nil {
+			data = block.Bytes
+		}
+		list, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return err
+		}
+
+		for _, chain := range chains {
+			if len(chain) < 2 {
+				continue
+			}
+			// 只使用由签发该证书的ca签名的吊销列表.
+			if err := list.CheckSignatureFrom(chain[1]); err != nil {
+				return err
+			}
+			for _, entry := range list.RevokedCertificateEntries {
+				if entry.SerialNumber.Cmp(chain[0].SerialNumber) == 0 {
+					return fmt.Errorf("certificate %x revoked", chain[0].SerialNumber)
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+// describeCert 用于日志, PEM内容不输出.
+func describeCert(v string) string {
+	if isPEM(v) {
+		return "inline PEM"
+	}
+	return v
+}
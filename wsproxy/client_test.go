@@ -0,0 +1,124 @@
+package wsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitee.com/jackarain/wsproxy/websocket"
+	"github.com/gobwas/ws"
+)
+
+func TestClientVerifiesServer(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+
+	server := "wss://" + strings.TrimPrefix(srv.URL, "https://")
+
+	// httptest 的证书不在系统证书中, 默认配置必须拒绝.
+	client, err := NewClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Dial("tcp", "example.com:80")
+	var unknown x509.UnknownAuthorityError
+	if !errors.As(err, &unknown) {
+		t.Fatalf("Dial with default tls config error = %v, want unknown authority", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	client, err = NewClientWithTLS(&tls.Config{RootCAs: pool}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := client.dialer.(*groupDialer).dialers[0].(*wsDialer)
+	conn, err := dialWebsocket(1, d.server, d.tlsConfig, nil)
+	if err != nil {
+		t.Fatalf("dialWebsocket with trusted ca: %v", err)
+	}
+	conn.Close()
+}
+
+// TestClientDialContext 通过进程内的服务器连接本机echo服务, 超过最大帧长度的写入也能完整往返.
+func TestClientDialContext(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	s, err := NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewTLSServer(s)
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	client, err := NewClientWithTLS(&tls.Config{RootCAs: pool}, "wss://"+strings.TrimPrefix(srv.URL, "https://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.DialContext(context.Background(), "udp", echo.Addr().String()); err == nil {
+		t.Fatal("udp dial accepted")
+	}
+
+	conn, err := client.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	for _, size := range []int{5, websocket.DefaultMaxFrameSize + 1, websocket.DefaultMaxMessageSize + 1} {
+		msg := make([]byte, size)
+		rand.Read(msg)
+
+		written := make(chan error, 1)
+		go func() {
+			_, err := conn.Write(msg)
+			written <- err
+		}()
+
+		got := make([]byte, size)
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("read %d bytes back: %v", size, err)
+		}
+		if err := <-written; err != nil {
+			t.Fatalf("write %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("echo of %d bytes differs", size)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package wsproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Dialer 出站连接接口, 直连、上游socks5/http代理、wsproxy隧道均实现该接口.
+type Dialer interface {
+	Dial(m *Metadata) (net.Conn, error)
+}
+
+type rejectDialer struct{}
+
+func (rejectDialer) Dial(m *Metadata) (net.Conn, error) {
+	return nil, ErrRejected
+}
+
+var (
+	// Direct 直接连接目标.
+	Direct Dialer = &directDialer{
+		timeout: defaultConnectTimeout,
+	}
+
+	// Reject 拒绝所有连接.
+	Reject Dialer = rejectDialer{}
+)
+
+// dialForward 通过forward连接到代理服务器自身的地址addr.
+func dialForward(forward Dialer, m *Metadata, addr string) (net.Conn, error) {
+	host, port, err := parseHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return forward.Dial(&Metadata{
+		ID:     m.ID,
+		Source: m.Source,
+		Local:  m.Local,
+		User:   m.User,
+		Host:   host,
+		Port:   port,
+	})
+}
+
+// socks5Dialer 通过上游socks5代理连接目标.
+type socks5Dialer struct {
+	server  string
+	user    *url.Userinfo
+	forward Dialer
+}
+
+func (d *socks5Dialer) Dial(m *Metadata) (net.Conn, error) {
+	conn, err := dialForward(d.forward, m, d.server)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := socks5Connect(conn, d.user, m.Host, m.Port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// httpDialer 通过上游http代理的CONNECT方法连接目标.
+type httpDialer struct {
+	server  string
+	user    *url.Userinfo
+	forward Dialer
+}
+
+func (d *httpDialer) Dial(m *Metadata) (net.Conn, error) {
+	conn, err := dialForward(d.forward, m, d.server)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := httpConnect(conn, d.user, m.Address())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// wsDialer 通过另一个wsproxy服务器的websocket隧道连接目标, tlsConfig 为nil时使用 upstreamTLSConfig.
+type wsDialer struct {
+	server    string
+	user      *url.Userinfo
+	forward   Dialer
+	tlsConfig *tls.Config
+}
+
+func (d *wsDialer) Dial(m *Metadata) (net.Conn, error) {
+	netDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialForward(d.forward, m, addr)
+	}
+
+	conn, err := dialWebsocket(m.ID, d.server, d.tlsConfig, netDial)
+	if err != nil {
+		return nil, err
+	}
+	if err := socks5Connect(conn, d.user, m.Host, m.Port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// groupDialer 从一组出站中随机选择一个.
+type groupDialer struct {
+	name    string
+	dialers []Dialer
+}
+
+func (d *groupDialer) Dial(m *Metadata) (net.Conn, error) {
+	if len(d.dialers) == 0 {
+		return nil, fmt.Errorf("no upstream server in group %q", d.name)
+	}
+
+	return d.dialers[rand.Intn(len(d.dialers))].Dial(m)
+}
+
+// NewDialer 根据url创建出站, 支持 socks5://、http://、ws://、wss:// 及 direct、reject,
+// forward 用于连接代理服务器本身, 为nil时直连.
+func NewDialer(rawurl string, forward Dialer) (Dialer, error) {
+	if forward == nil {
+		forward = Direct
+	}
+
+	switch strings.ToLower(rawurl) {
+	case ActionDirect:
+		return Direct, nil
+	case ActionReject:
+		return Reject, nil
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "socks5", "socks5h":
+		return &socks5Dialer{
+			server:  hostPortDefault(u, "1080"),
+			user:    u.User,
+			forward: forward,
+		}, nil
+	case "http":
+		return &httpDialer{
+			server:  hostPortDefault(u, "80"),
+			user:    u.User,
+			forward: forward,
+		}, nil
+	case "ws", "wss":
+		// 检查 compression 参数, 拨号时再从url中取出.
+		if value := u.Query().Get("compression"); value != "" {
+			if _, err := parseEncoding(value); err != nil {
+				return nil, err
+			}
+		}
+		return &wsDialer{
+			server:  rawurl,
+			user:    u.User,
+			forward: forward,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported outbound %q", rawurl)
+}
+
+func hostPortDefault(u *url.URL, port string) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	return u.Host
+}
@@ -0,0 +1,250 @@
+package wsproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultConnectTimeout = 15 * time.Second
+
+	// connectionAttemptDelay RFC 8305 推荐的相邻两次连接尝试间隔.
+	connectionAttemptDelay = 250 * time.Millisecond
+)
+
+// DirectConfig 直连出站配置.
+type DirectConfig struct {
+	// ConnectTimeout 连接超时, 单位秒, 包含域名解析时间.
+	ConnectTimeout int `json:"ConnectTimeout"`
+
+	// BindAddress 连接使用的本地源地址, 可以同时配置一个ipv4和一个ipv6地址.
+	BindAddress []string `json:"BindAddress"`
+
+	// Interface 连接使用的出口网卡.
+	Interface string `json:"Interface"`
+}
+
+// directDialer 直接连接目标, 多个地址时按 RFC 8305 (Happy Eyeballs) 交替尝试ipv6/ipv4.
+type directDialer struct {
+	timeout   time.Duration
+	bindIPv4  net.IP
+	bindIPv6  net.IP
+	iface     string
+	ifaceIPv4 net.IP
+	ifaceIPv6 net.IP
+}
+
+// NewDirectDialer 根据配置创建直连出站.
+func NewDirectDialer(config DirectConfig) (Dialer, error) {
+	d := &directDialer{
+		timeout: defaultConnectTimeout,
+		iface:   config.Interface,
+	}
+
+	if config.ConnectTimeout > 0 {
+		d.timeout = time.Duration(config.ConnectTimeout) * time.Second
+	}
+
+	for _, addr := range config.BindAddress {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid bind address %q", addr)
+		}
+		if ip.To4() != nil {
+			d.bindIPv4 = ip
+		} else {
+			d.bindIPv6 = ip
+		}
+	}
+
+	if d.iface != "" {
+		iface, err := net.InterfaceByName(d.iface)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipnet.IP.To4() != nil && d.ifaceIPv4 == nil {
+				d.ifaceIPv4 = ipnet.IP
+			} else if ipnet.IP.To4() == nil && d.ifaceIPv6 == nil && !ipnet.IP.IsLinkLocalUnicast() {
+				d.ifaceIPv6 = ipnet.IP
+			}
+		}
+	}
+
+	return d, nil
+}
+
+// localAddr 返回连接ip时使用的本地地址, 源地址优先于网卡地址.
+func (d *directDialer) localAddr(ip net.IP) net.Addr {
+	local := d.bindIPv6
+	if ip.To4() != nil {
+		local = d.bindIPv4
+	}
+	if local == nil && !bindToDeviceSupported {
+		local = d.ifaceIPv6
+		if ip.To4() != nil {
+			local = d.ifaceIPv4
+		}
+	}
+	if local == nil {
+		return nil
+	}
+
+	return &net.TCPAddr{IP: local}
+}
+
+// interleave 按 RFC 8305 交替排列两种地址族, 保持首个地址的地址族优先.
+func interleave(ips []net.IP) []net.IP {
+	if len(ips) == 0 {
+		return ips
+	}
+
+	first := ips[0].To4() != nil
+	var primary, secondary []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == first {
+			primary = append(primary, ip)
+		} else {
+			secondary = append(secondary, ip)
+		}
+	}
+
+	result := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(primary) || i < len(secondary); i++ {
+		if i < len(primary) {
+			result = append(result, primary[i])
+		}
+		if i < len(secondary) {
+			result = append(result, secondary[i])
+		}
+	}
+
+	return result
+}
+
+func (d *directDialer) dialIP(ctx context.Context, ip net.IP, port uint16) (net.Conn, error) {
+	nd := net.Dialer{
+		LocalAddr: d.localAddr(ip),
+	}
+	if d.iface != "" && bindToDeviceSupported {
+		nd.Control = bindToDevice(d.iface)
+	}
+
+	return nd.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+}
+
+// listen 为BIND命令监听, 与连接时使用相同的源地址及出口网卡, 多网卡时目标主机才能连到正确的地址.
+// ip 为预期连入的主机地址, 为nil(域名)时按配置的源地址选择地址族, ipv4优先.
+func (d *directDialer) listen(ip net.IP) (net.Listener, error) {
+	network := "tcp"
+	if ip != nil && ip.To4() != nil {
+		network = "tcp4"
+	}
+	if ip == nil {
+		ip = net.IPv4zero
+		if d.bindIPv4 == nil && d.ifaceIPv4 == nil && (d.bindIPv6 != nil || d.ifaceIPv6 != nil) {
+			ip = net.IPv6zero
+		}
+	}
+
+	address := ":0"
+	if local, ok := d.localAddr(ip).(*net.TCPAddr); ok {
+		address = net.JoinHostPort(local.IP.String(), "0")
+	}
+
+	lc := net.ListenConfig{}
+	if d.iface != "" && bindToDeviceSupported {
+		lc.Control = bindToDevice(d.iface)
+	}
+
+	return lc.Listen(context.Background(), network, address)
+}
+
+func (d *directDialer) Dial(m *Metadata) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	ips, err := DefaultResolver.LookupIP(ctx, m.Host)
+	if err != nil {
+		return nil, err
+	}
+	// 解析器可能返回空结果而没有错误, 此时没有可以连接的地址.
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: errNoAddress.Error(), Name: m.Host, IsNotFound: true}
+	}
+	ips = interleave(ips)
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult)
+	done := make(chan struct{})
+	defer close(done)
+
+	pending := 0
+	next := 0
+	attempt := func() {
+		ip := ips[next]
+		next++
+		pending++
+
+		go func() {
+			conn, err := d.dialIP(ctx, ip, m.Port)
+			select {
+			case results <- dialResult{conn, err}:
+			case <-done:
+				// 已经有其它地址连接成功, 关闭多余的连接.
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		}()
+	}
+
+	attempt()
+	timer := time.NewTimer(connectionAttemptDelay)
+	defer timer.Stop()
+
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			// 上一次尝试超过间隔时间未完成, 并行尝试下一个地址.
+			if next < len(ips) {
+				attempt()
+				timer.Reset(connectionAttemptDelay)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.conn, nil
+			}
+			err = res.err
+
+			// 失败时立即尝试下一个地址.
+			if next < len(ips) {
+				attempt()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(connectionAttemptDelay)
+			}
+		}
+	}
+
+	return nil, err
+}
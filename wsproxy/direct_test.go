@@ -0,0 +1,35 @@
+package wsproxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDirectListenBindAddress(t *testing.T) {
+	d, err := NewDirectDialer(DirectConfig{BindAddress: []string{"127.0.0.2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"192.0.2.1", "example.com"} {
+		l, err := d.(*directDialer).listen(net.ParseIP(host))
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := l.Addr().(*net.TCPAddr)
+		l.Close()
+		if !addr.IP.Equal(net.ParseIP("127.0.0.2")) {
+			t.Errorf("bind for %s listens on %v, want 127.0.0.2", host, addr)
+		}
+	}
+
+	// 没有配置源地址时监听所有地址.
+	l, err := Direct.(*directDialer).listen(net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if ip := l.Addr().(*net.TCPAddr).IP; !ip.IsUnspecified() {
+		t.Errorf("default bind listens on %v, want unspecified", ip)
+	}
+}
@@ -0,0 +1,77 @@
+package wsproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"gitee.com/jackarain/wsproxy/websocket"
+	"github.com/gobwas/ws"
+)
+
+// ServeHTTP 实现 http.Handler, 把请求升级为websocket隧道, 用于挂载到已有的 net/http 服务中.
+// 隧道中的socks5/http代理请求与 StartWithAuth 使用相同的用户认证、编码及出站配置.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ID := atomic.AddUint64(&ConnectionID, 1)
+
+	// 明文握手与独立监听时的限制相同.
+	if r.TLS == nil {
+		var remote net.Addr
+		if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+			remote = addr
+		}
+		if err := s.plainWebsocketAllowed(remote); err != nil {
+			fmt.Println(ID, "Refuse plain websocket from", r.RemoteAddr, err.Error())
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
+	// 按客户端的优先顺序协商压缩方式, 在升级回复中确认.
+	compression, deflate := websocket.NegotiateCompression(r.Header["Sec-Websocket-Extensions"])
+	u := ws.HTTPUpgrader{}
+	if compression != "" {
+		u.Header = http.Header{"Sec-Websocket-Extensions": {websocket.CompressionResponse(compression, deflate)}}
+	}
+
+	conn, rw, _, err := u.Upgrade(r, w)
+	if err != nil {
+		fmt.Println(ID, "http request Upgrade to websocket", err.Error())
+		return
+	}
+
+	bc := bufferedConn{rw, conn}
+	defer bc.Close()
+
+	in := &inboundConn{
+		ID:     ID,
+		conn:   conn,
+		bc:     bc,
+		remote: conn.RemoteAddr(),
+		local:  conn.LocalAddr(),
+		secure: r.TLS != nil,
+	}
+
+	// 经由可信反向代理连入时, 使用其转发的客户端地址.
+	if remote := s.forwardedFor(in.remote, r.Header); remote != in.remote {
+		fmt.Println(ID, "Websocket from", in.remote, "forwarded for", remote)
+		in.remote = remote
+	}
+
+	fmt.Println(ID, "* Start websocket handler with client:", in.remote)
+
+	var rwc io.ReadWriter = bc
+	s.relayWebsocket(in, &websocket.Websocket{
+		Conn:     &rwc,
+		Encoding: r.Header.Get("Content-Encoding"),
+		URI:      r.RequestURI,
+		Header:   r.Header,
+
+		Compression: compression,
+		Deflate:     deflate,
+	})
+
+	fmt.Println(ID, "- Websocket handler disconnect...")
+}
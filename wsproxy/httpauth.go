@@ -0,0 +1,328 @@
+package wsproxy
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AuthSchemeBasic 用户名密码明文认证.
+	AuthSchemeBasic = "Basic"
+
+	// AuthSchemeDigest 摘要认证, 需要在配置的Users中保存密码.
+	AuthSchemeDigest = "Digest"
+
+	// AuthSchemeBearer 令牌认证, 令牌在配置的Users中设置.
+	AuthSchemeBearer = "Bearer"
+
+	digestNonceLifetime = 5 * time.Minute
+	digestNonceLimit    = 65536
+)
+
+var (
+	// Tokens for bearer auth, token -> user ...
+	Tokens map[string]string
+
+	// httpAuth http代理认证, 由NewServer根据配置创建.
+	httpAuth = newHTTPAuthenticator(HTTPAuthConfig{})
+
+	// passwordLookup Digest认证查询明文密码, tokenLookup Bearer认证及socks4令牌查询用户,
+	// 默认使用配置中的Users, 通过 Server.PasswordHandleFunc 及 Server.TokenHandleFunc 替换.
+	passwordLookup PasswordLookupFunc = configPassword
+	tokenLookup    TokenLookupFunc    = configToken
+)
+
+// PasswordLookupFunc 返回用户的明文密码, Digest认证需要密码计算摘要, 不能通过 AuthHandlerFunc 校验.
+type PasswordLookupFunc func(user string) (string, bool)
+
+// TokenLookupFunc 返回令牌对应的用户名.
+type TokenLookupFunc func(token string) (string, bool)
+
+// configPassword 从配置的Users中查询密码.
+func configPassword(user string) (string, bool) {
+	passwd, found := Users[user]
+	return passwd, found
+}
+
+// configToken 从配置的Users中查询令牌对应的用户.
+func configToken(token string) (string, bool) {
+	user, found := Tokens[token]
+	return user, found
+}
+
+// HTTPAuthConfig http代理认证配置.
+type HTTPAuthConfig struct {
+	Realm   string   `json:"Realm"`
+	Schemes []string `json:"Schemes"`
+}
+
+type digestNonce struct {
+	created time.Time
+	nc      uint64
+}
+
+// httpAuthenticator 实现 Basic/Digest/Bearer 三种代理认证.
+type httpAuthenticator struct {
+	realm   string
+	schemes []string
+
+	mu     sync.Mutex
+	nonces map[string]*digestNonce
+
+	// order 按创建顺序排列的nonce, 用于清理过期及淘汰最旧的nonce.
+	order []string
+}
+
+func newHTTPAuthenticator(config HTTPAuthConfig) *httpAuthenticator {
+	a := &httpAuthenticator{
+		realm:   config.Realm,
+		schemes: config.Schemes,
+		nonces:  make(map[string]*digestNonce),
+	}
+
+	if a.realm == "" {
+		a.realm = "proxy"
+	}
+	if len(a.schemes) == 0 {
+		a.schemes = []string{AuthSchemeBasic}
+	}
+
+	return a
+}
+
+// checkHTTPAuthConfig 检查配置中的认证方式.
+func checkHTTPAuthConfig(config HTTPAuthConfig) error {
+	for _, scheme := range config.Schemes {
+		switch scheme {
+		case AuthSchemeBasic, AuthSchemeDigest, AuthSchemeBearer:
+		default:
+			return fmt.Errorf("unknown http auth scheme %q", scheme)
+		}
+	}
+
+	return nil
+}
+
+func (a *httpAuthenticator) enabled(scheme string) bool {
+	for _, s := range a.schemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// newNonce 生成并记录一个digest nonce, 同时清理过期的nonce, 达到上限时淘汰最旧的nonce,
+// 避免大量未认证的请求耗尽nonce后正常用户无法认证.
+func (a *httpAuthenticator) newNonce() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	nonce := hex.EncodeToString(buf)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for len(a.order) > 0 {
+		oldest := a.order[0]
+		n, found := a.nonces[oldest]
+		if found && now.Sub(n.created) <= digestNonceLifetime && len(a.nonces) < digestNonceLimit {
+			break
+		}
+		delete(a.nonces, oldest)
+		a.order = a.order[1:]
+	}
+
+	a.nonces[nonce] = &digestNonce{created: now}
+	a.order = append(a.order, nonce)
+
+	return nonce
+}
+
+// useNonce 校验nonce并要求nc递增以防止重放, 返回nonce是否有效及是否过期.
+func (a *httpAuthenticator) useNonce(nonce string, nc uint64) (valid, stale bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	n, found := a.nonces[nonce]
+	if !found {
+		return false, true
+	}
+	if time.Since(n.created) > digestNonceLifetime {
+		delete(a.nonces, nonce)
+		return false, true
+	}
+	if nc <= n.nc {
+		return false, false
+	}
+	n.nc = nc
+
+	return true, false
+}
+
+// parseAuthParams 解析 key=value, key="value" 形式的认证参数.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " \t,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, "\"") {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			value = b.String()
+			if i < len(s) {
+				i++
+			}
+			s = s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+
+		params[key] = value
+	}
+
+	return params
+}
+
+func digestHash(algorithm string) func() hash.Hash {
+	switch strings.ToUpper(algorithm) {
+	case "", "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+func hashHex(h func() hash.Hash, s string) string {
+	d := h()
+	d.Write([]byte(s))
+	return hex.EncodeToString(d.Sum(nil))
+}
+
+// authDigest 按 RFC 7616 校验摘要认证, 只支持 qop=auth.
+func (a *httpAuthenticator) authDigest(req *http.Request, params map[string]string) (user string, ok, stale bool) {
+	user = params["username"]
+	h := digestHash(params["algorithm"])
+	if h == nil || params["realm"] != a.realm || params["qop"] != "auth" {
+		return "", false, false
+	}
+
+	// 代理请求中的uri必须与请求行一致.
+	if params["uri"] != req.RequestURI {
+		return "", false, false
+	}
+
+	nc, err := strconv.ParseUint(params["nc"], 16, 64)
+	if err != nil {
+		return "", false, false
+	}
+
+	passwd, found := passwordLookup(user)
+	if !found {
+		return "", false, false
+	}
+
+	ha1 := hashHex(h, user+":"+a.realm+":"+passwd)
+	ha2 := hashHex(h, req.Method+":"+params["uri"])
+	expected := hashHex(h, strings.Join([]string{
+		ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2}, ":"))
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(params["response"])) != 1 {
+		return "", false, false
+	}
+
+	valid, stale := a.useNonce(params["nonce"], nc)
+	if !valid {
+		return "", false, stale
+	}
+
+	return user, true, false
+}
+
+// authenticate 校验 Proxy-Authorization, 返回认证通过的用户名, stale表示digest nonce已过期.
+// Basic使用handler校验, Digest及Bearer分别使用 passwordLookup 及 tokenLookup.
+func (a *httpAuthenticator) authenticate(req *http.Request, handler AuthHandlerFunc) (user string, ok, stale bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	sp := strings.IndexByte(auth, ' ')
+	if sp < 0 {
+		return "", false, false
+	}
+	scheme := auth[:sp]
+
+	switch {
+	case strings.EqualFold(scheme, AuthSchemeBasic) && a.enabled(AuthSchemeBasic):
+		user, passwd, ok := parseBasicAuth(auth)
+		if ok && handler(user, passwd) {
+			return user, true, false
+		}
+	case strings.EqualFold(scheme, AuthSchemeDigest) && a.enabled(AuthSchemeDigest):
+		return a.authDigest(req, parseAuthParams(auth[sp+1:]))
+	case strings.EqualFold(scheme, AuthSchemeBearer) && a.enabled(AuthSchemeBearer):
+		if user, found := tokenLookup(strings.TrimSpace(auth[sp+1:])); found {
+			return user, true, false
+		}
+	}
+
+	return "", false, false
+}
+
+// challenge 返回407应答, 每种启用的认证方式各一个 Proxy-Authenticate 头.
+func (a *httpAuthenticator) challenge(req *http.Request, stale bool) *http.Response {
+	header := http.Header{}
+
+	for _, scheme := range a.schemes {
+		switch scheme {
+		case AuthSchemeBasic:
+			header.Add("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", a.realm))
+		case AuthSchemeDigest:
+			for _, algorithm := range []string{"SHA-256", "MD5"} {
+				v := fmt.Sprintf("Digest realm=%q, qop=\"auth\", algorithm=%s, nonce=%q",
+					a.realm, algorithm, a.newNonce())
+				if stale {
+					v += ", stale=true"
+				}
+				header.Add("Proxy-Authenticate", v)
+			}
+		case AuthSchemeBearer:
+			header.Add("Proxy-Authenticate", fmt.Sprintf("Bearer realm=%q", a.realm))
+		}
+	}
+
+	return &http.Response{
+		StatusCode:    http.StatusProxyAuthRequired,
+		ProtoMajor:    req.ProtoMajor,
+		ProtoMinor:    req.ProtoMinor,
+		Header:        header,
+		ContentLength: 0,
+	}
+}
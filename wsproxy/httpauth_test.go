@@ -0,0 +1,51 @@
+package wsproxy
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDigestNonceEviction(t *testing.T) {
+	a := newHTTPAuthenticator(HTTPAuthConfig{Schemes: []string{AuthSchemeDigest}})
+
+	first := a.newNonce()
+	for i := 0; i < digestNonceLimit; i++ {
+		a.newNonce()
+	}
+	last := a.newNonce()
+
+	if len(a.nonces) > digestNonceLimit {
+		t.Fatalf("stored nonces = %d, want at most %d", len(a.nonces), digestNonceLimit)
+	}
+	if valid, stale := a.useNonce(first, 1); valid || !stale {
+		t.Fatalf("oldest nonce valid=%v stale=%v, want evicted", valid, stale)
+	}
+	if valid, _ := a.useNonce(last, 1); !valid {
+		t.Fatal("newest nonce rejected after the limit was reached")
+	}
+	if valid, _ := a.useNonce(last, 1); valid {
+		t.Fatal("replayed nonce count accepted")
+	}
+}
+
+func TestBearerTokenLookup(t *testing.T) {
+	a := newHTTPAuthenticator(HTTPAuthConfig{Schemes: []string{AuthSchemeBearer}})
+	s := &Server{}
+	s.TokenHandleFunc(func(token string) (string, bool) {
+		return "alice", token == "secret"
+	})
+	defer s.TokenHandleFunc(nil)
+
+	deny := func(string, string) bool { return false }
+	req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+
+	req.Header.Set("Proxy-Authorization", "Bearer secret")
+	if user, ok, _ := a.authenticate(req, deny); !ok || user != "alice" {
+		t.Fatalf("authenticate = %q, %v, want alice", user, ok)
+	}
+
+	req.Header.Set("Proxy-Authorization", "Bearer other")
+	if _, ok, _ := a.authenticate(req, deny); ok {
+		t.Fatal("unknown token accepted")
+	}
+}
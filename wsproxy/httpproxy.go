@@ -5,24 +5,19 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"strings"
 )
 
 const (
-	hs407 = "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authorization: Basic realm=\"proxy\"\r\n\r\n"
-	hs401 = "HTTP/1.1 401 Unauthorized\r\nProxy-Authorization: Basic realm=\"proxy\"\r\n\r\n"
 	hs200 = "HTTP/1.1 200 Connection established\r\n\r\n"
-)
 
-func porxyAuth(req *http.Request) (username, password string, ok bool) {
-	auth := req.Header.Get("Proxy-Authorization")
-	if auth == "" {
-		return
-	}
-	return parseBasicAuth(auth)
-}
+	// maxHTTPAuthAttempts 同一连接上允许的最多认证次数.
+	maxHTTPAuthAttempts = 3
+)
 
 func parseBasicAuth(auth string) (username, password string, ok bool) {
 	const prefix = "Basic "
@@ -52,70 +47,138 @@ func makeResponse(resp *http.Response) []byte {
 	return buf.Bytes()
 }
 
+// httpStatusCode 把出站连接错误转换为http状态码.
+func httpStatusCode(err error) int {
+	switch socks5ReplyCode(err) {
+	case socks5RepNotAllowed:
+		return http.StatusForbidden
+	case socks5RepTTLExpired:
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
+
+// writeHTTPError 回复错误状态码, 错误原因作为纯文本响应体.
+func writeHTTPError(writer *bufio.Writer, req *http.Request, code int, reason string) {
+	resp := http.Response{
+		StatusCode:    code,
+		ProtoMajor:    req.ProtoMajor,
+		ProtoMinor:    req.ProtoMinor,
+		Close:         true,
+		ContentLength: int64(len(reason) + 1),
+		Body:          ioutil.NopCloser(strings.NewReader(reason + "\n")),
+		Header: http.Header{
+			"Content-Type": []string{"text/plain; charset=utf-8"},
+		},
+	}
+
+	writer.Write(makeResponse(&resp))
+	writer.Flush()
+}
+
 // StartHTTPProxy ...
 func StartHTTPProxy(ID uint64, tcpConn *bufio.ReadWriter, handler AuthHandlerFunc,
-	reader *bufio.Reader, writer *bufio.Writer) {
+	dial DialFunc, reader *bufio.Reader, writer *bufio.Writer) {
 
 	fmt.Println(ID, "Start http proxy...")
 
-	// 读取client的request.
-	req, err := http.ReadRequest(reader)
-	if err != nil {
-		fmt.Println(ID, "HttpProxy read request error", err.Error())
-		return
-	}
+	var req *http.Request
+	user := ""
 
-	resp := http.Response{
-		ProtoMajor: req.ProtoMajor,
-		ProtoMinor: req.ProtoMinor,
-		Close:      false,
-	}
-
-	// 如果访问的不是CONNECT, 统一返回HTTP 200 OK.
-	if req.Method != "CONNECT" {
-		resp.Status = "200 OK"
-		resp.StatusCode = 200
-		resp.ContentLength = 0
+	// 认证失败时回复407并保持连接, 以便客户端在同一连接上完成digest等质询认证.
+	for attempt := 0; ; attempt++ {
+		// 读取client的request.
+		var err error
+		req, err = http.ReadRequest(reader)
+		if err != nil {
+			fmt.Println(ID, "HttpProxy read request error", err.Error())
+			return
+		}
 
-		resp.Header = http.Header{
-			"Server": []string{"nginx/1.19.0"},
+		resp := http.Response{
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Close:      false,
 		}
 
-		writer.Write(makeResponse(&resp))
-		writer.Flush()
+		// 不是代理请求(CONNECT或绝对地址)时, 统一返回HTTP 200 OK.
+		if req.Method != "CONNECT" && !req.URL.IsAbs() {
+			resp.Status = "200 OK"
+			resp.StatusCode = 200
+			resp.ContentLength = 0
 
-		return
-	}
+			resp.Header = http.Header{
+				"Server": []string{"nginx/1.19.0"},
+			}
 
-	user, passwd, ok := porxyAuth(req)
-	if handler != nil {
-		if !ok {
-			writer.Write([]byte(hs407))
+			writer.Write(makeResponse(&resp))
 			writer.Flush()
 
 			return
-		} else if !handler(user, passwd) {
-			writer.Write([]byte(hs401))
-			writer.Flush()
+		}
 
-			return
-		} else {
-			writer.Write([]byte(hs200))
-			writer.Flush()
+		if handler == nil {
+			break
 		}
-	} else if handler == nil {
-		writer.Write([]byte(hs200))
+
+		var ok, stale bool
+		user, ok, stale = httpAuth.authenticate(req, handler)
+		if ok {
+			break
+		}
+
+		challenge := httpAuth.challenge(req, stale)
+		challenge.Close = attempt+1 >= maxHTTPAuthAttempts
+		writer.Write(makeResponse(challenge))
 		writer.Flush()
+
+		if challenge.Close {
+			fmt.Println(ID, "HttpProxy authentication failed")
+			return
+		}
+	}
+
+	if req.Method != "CONNECT" {
+		forwardHTTPRequest(ID, req, user, dial, writer)
+		return
 	}
 
 	hostname := req.RequestURI
 	fmt.Println(ID, "Start connect to:", hostname)
-	targetConn, err := net.Dial("tcp", hostname)
+
+	host, portStr, err := net.SplitHostPort(hostname)
 	if err != nil {
+		fmt.Println(ID, "HttpProxy invalid host", hostname, err.Error())
+		writeHTTPError(writer, req, http.StatusBadRequest, "invalid CONNECT target "+hostname)
+		return
+	}
+	port, err := parsePort(portStr)
+	if err != nil {
+		fmt.Println(ID, "HttpProxy invalid port", hostname, err.Error())
+		writeHTTPError(writer, req, http.StatusBadRequest, "invalid CONNECT target "+hostname)
+		return
+	}
+
+	m := &Metadata{
+		User: user,
+		Host: host,
+		Port: port,
+	}
+
+	// 连接目标成功后才回复 200, 失败时按错误类型回复 403/502/504.
+	targetConn, err := dial(m)
+	if err != nil {
+		code := httpStatusCode(err)
+		fmt.Println(ID, "HttpProxy connect to", hostname, "error", err.Error(), "reply", code)
+		writeHTTPError(writer, req, code, "connect to "+hostname+" failed: "+err.Error())
 		return
 	}
 	defer targetConn.Close()
 
+	writer.Write([]byte(hs200))
+	writer.Flush()
+
 	// Start proxying
 	errCh := make(chan error, 2)
 	tw := bufio.NewWriter(targetConn)
@@ -130,3 +193,82 @@ func StartHTTPProxy(ID uint64, tcpConn *bufio.ReadWriter, handler AuthHandlerFun
 		}
 	}
 }
+
+// hopHeaders 逐跳首部, 转发请求时需要删除.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardHTTPRequest 转发 GET http://host/path 形式的普通http代理请求, 每个连接只转发一个请求.
+func forwardHTTPRequest(ID uint64, req *http.Request, user string, dial DialFunc, writer *bufio.Writer) {
+	if req.URL.Scheme != "http" {
+		fmt.Println(ID, "HttpProxy unsupported scheme", req.URL.Scheme)
+		writeHTTPError(writer, req, http.StatusBadRequest, "unsupported scheme "+req.URL.Scheme)
+		return
+	}
+
+	hostname := req.URL.Host
+	if req.URL.Port() == "" {
+		hostname = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	fmt.Println(ID, "Start forward", req.Method, "to:", hostname)
+
+	host, port, err := parseHostPort(hostname)
+	if err != nil {
+		fmt.Println(ID, "HttpProxy invalid host", hostname, err.Error())
+		writeHTTPError(writer, req, http.StatusBadRequest, "invalid target "+hostname)
+		return
+	}
+
+	m := &Metadata{
+		User: user,
+		Host: host,
+		Port: port,
+	}
+
+	targetConn, err := dial(m)
+	if err != nil {
+		code := httpStatusCode(err)
+		fmt.Println(ID, "HttpProxy connect to", hostname, "error", err.Error(), "reply", code)
+		writeHTTPError(writer, req, code, "connect to "+hostname+" failed: "+err.Error())
+		return
+	}
+	defer targetConn.Close()
+
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.Close = true
+
+	// 请求以 origin-form 写往目标, 响应原样返回给客户端直到目标关闭连接.
+	tw := bufio.NewWriter(targetConn)
+	if err := req.Write(tw); err != nil {
+		fmt.Println(ID, "HttpProxy write request error", err.Error())
+		return
+	}
+	tw.Flush()
+
+	// 每次读到数据后立即发送, SSE、chunked长轮询等流式响应不会停留在缓冲区中.
+	io.Copy(flushWriter{writer}, targetConn)
+}
+
+// flushWriter 每次写入后flush缓冲区.
+type flushWriter struct {
+	w *bufio.Writer
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, f.w.Flush()
+}
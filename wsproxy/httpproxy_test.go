@@ -0,0 +1,56 @@
+package wsproxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestForwardHTTPRequestStreams 目标连接保持打开时, 已收到的响应数据也要立即转发给客户端.
+func TestForwardHTTPRequestStreams(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	release := make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		http.ReadRequest(bufio.NewReader(conn))
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\n\r\ndata: first\n\n"))
+		<-release
+	}()
+	defer close(release)
+
+	client, proxy := net.Pipe()
+	defer client.Close()
+	defer proxy.Close()
+
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(
+		"GET http://" + l.Addr().String() + "/events HTTP/1.1\r\nHost: " + l.Addr().String() + "\r\n\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(m *Metadata) (net.Conn, error) {
+		return net.Dial("tcp", m.Address())
+	}
+	go forwardHTTPRequest(1, req, "", dial, bufio.NewWriter(proxy))
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("response held back while the target is open: %v", err)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "data: first\n" {
+		t.Fatalf("event = %q, %v", line, err)
+	}
+}
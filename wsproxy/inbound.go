@@ -0,0 +1,433 @@
+package wsproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// PassthroughConfig tls连接按SNI/ALPN原样转发到其他服务器, 不在本地解密.
+type PassthroughConfig struct {
+	// ServerName 支持 *.example.com 形式的通配, 为空时匹配所有SNI.
+	ServerName []string `json:"ServerName"`
+	ALPN       []string `json:"ALPN"`
+
+	// Target 转发目标 host:port, 为空时转发到SNI的443端口, 此时必须配置 ServerName.
+	Target string `json:"Target"`
+}
+
+// checkPassthroughConfig 检查透传配置, Target 为空时必须用 ServerName 限定SNI,
+// 否则任何人都可以通过伪造SNI把服务器当作转发到任意主机的中继.
+func checkPassthroughConfig(configs []PassthroughConfig) error {
+	for _, p := range configs {
+		for _, name := range p.ServerName {
+			if normalizeDomain(name) == "" {
+				return fmt.Errorf("empty server name in %v", p.ServerName)
+			}
+		}
+
+		if p.Target == "" {
+			if len(p.ServerName) == 0 {
+				return errors.New("ServerName is required when Target is empty")
+			}
+			continue
+		}
+		if _, _, err := parseHostPort(p.Target); err != nil {
+			return fmt.Errorf("invalid target %q: %w", p.Target, err)
+		}
+	}
+
+	return nil
+}
+
+// WebsocketConfig websocket入站配置, Path 及 Trusted 用于部署在nginx等终结tls的反向代理之后.
+type WebsocketConfig struct {
+	// Path 接受明文websocket握手的路径, 为空时只接受wss. 配置了 Trusted 时只接受来自可信反向代理的明文握手,
+	// 启用 Certs.RequireClientCert 时不接受明文握手.
+	Path string `json:"Path"`
+
+	// Trusted 可信反向代理的ip或网段, 来自这些地址的 X-Real-IP/X-Forwarded-For 作为客户端地址.
+	Trusted []string `json:"Trusted"`
+
+	// MaxFrameSize 及 MaxMessageSize 为websocket接收的帧及消息的最大长度, 单位字节, 为0时使用默认的1M及4M.
+	MaxFrameSize   int64 `json:"MaxFrameSize"`
+	MaxMessageSize int64 `json:"MaxMessageSize"`
+
+	// PingInterval websocket隧道两端发送Ping的间隔秒数, 为0时不发送.
+	// PongTimeout 等待Pong的超时秒数, 超时后关闭隧道及客户端连接, 为0时与 PingInterval 相同.
+	PingInterval int `json:"PingInterval"`
+	PongTimeout  int `json:"PongTimeout"`
+
+	// CompressionLevel 隧道压缩级别, 1-9, -1为默认级别, -2只使用哈夫曼编码, 为0时使用默认级别.
+	CompressionLevel int `json:"CompressionLevel"`
+
+	// MaxInflationRatio 压缩消息解压后与压缩前长度的最大比例, 为0时使用默认的1024, 小于0时只限制 MaxMessageSize,
+	// zstd 不按比例限制.
+	MaxInflationRatio int `json:"MaxInflationRatio"`
+
+	// AlwaysCompress 为true时压缩所有数据, 否则按每个隧道的压缩效果自适应, 不可压缩的数据(如tls流量)原样发送.
+	AlwaysCompress bool `json:"AlwaysCompress"`
+}
+
+// inboundConn 一个待处理的入站连接.
+type inboundConn struct {
+	ID    uint64
+	conn  net.Conn
+	bc    bufferedConn
+	hello *clientHello
+
+	// 客户端地址及客户端所连接的本机地址, 可被PROXY协议头替换.
+	remote net.Addr
+	local  net.Addr
+
+	// secure 已在本地完成tls握手; tunneled 来自wss隧道(unix socket)的连接;
+	// proxied 已经处理过PROXY协议头.
+	secure   bool
+	tunneled bool
+	proxied  bool
+}
+
+// inboundHandler 处理一种入站协议, tunnel表示是否接受来自wss隧道的连接.
+type inboundHandler struct {
+	handle func(s *Server, in *inboundConn)
+	tunnel bool
+}
+
+// inboundHandlers 按sniff识别出的协议注册的入站处理.
+var inboundHandlers = map[string]inboundHandler{}
+
+func registerInbound(proto string, handle func(s *Server, in *inboundConn), tunnel bool) {
+	inboundHandlers[proto] = inboundHandler{handle: handle, tunnel: tunnel}
+}
+
+func init() {
+	registerInbound(protoSocks5, (*Server).serveSocks5, true)
+	registerInbound(protoSocks4, (*Server).serveSocks4, true)
+	registerInbound(protoHTTP, (*Server).serveHTTP, true)
+	registerInbound(protoWebsocket, (*Server).serveWebsocket, true)
+	registerInbound(protoTLS, (*Server).serveTLS, false)
+	registerInbound(protoPassthrough, (*Server).servePassthrough, false)
+	registerInbound(protoProxyV1, (*Server).serveProxyProtocol, false)
+	registerInbound(protoProxyV2, (*Server).serveProxyProtocol, false)
+}
+
+// serveInbound 识别入站协议并交给对应的处理.
+func (s *Server) serveInbound(in *inboundConn) {
+	proto, hello, err := sniff(in.bc.rw.Reader)
+	if err != nil {
+		fmt.Println(in.ID, "Sniff protocol error", err.Error())
+		return
+	}
+
+	// 已解密的连接中不再接受tls, PROXY协议头只能出现在连接最开始.
+	if proto == protoTLS && in.secure {
+		proto = protoUnknown
+	}
+	if (proto == protoProxyV1 || proto == protoProxyV2) && (in.proxied || in.secure) {
+		proto = protoUnknown
+	}
+	if proto == protoTLS && s.matchPassthrough(hello) != nil {
+		proto = protoPassthrough
+	}
+	in.hello = hello
+
+	h, found := inboundHandlers[proto]
+	if !found || (in.tunneled && !h.tunnel) {
+		fmt.Println(in.ID, "- Unknown protocol!")
+		return
+	}
+
+	h.handle(s, in)
+}
+
+// auth 返回代理请求使用的认证函数, 没有配置用户时无需认证.
+func (s *Server) auth() AuthHandlerFunc {
+	if len(Users) == 0 {
+		return nil
+	}
+	return s.authFunc
+}
+
+// upstreamIndex 返回client模式下随机选择的上游服务器, 不需要原样转发时返回-1.
+func (s *Server) upstreamIndex(in *inboundConn) int {
+	// 配置了路由规则时, client模式也在本地解析代理请求, 再按规则选择出站方式.
+	if in.tunneled || len(s.config.Servers) == 0 || !s.router.Empty() {
+		return -1
+	}
+
+	return rand.Intn(len(s.config.Servers))
+}
+
+// forwardUpstream 把连接原样转发到上游wss服务器.
+func (s *Server) forwardUpstream(in *inboundConn, idx int) {
+	insize, tosize := StartConnectServer(in.ID, in.conn, in.bc.rw.Reader, in.bc.rw.Writer, s.config.Servers[idx])
+	fmt.Println(in.ID, "- Exit proxy with client:", in.remote, insize, tosize)
+}
+
+// relay 在入站连接和目标连接之间双向转发数据.
+func relay(in *inboundConn, targetConn net.Conn) {
+	errCh := make(chan error, 2)
+	tw := bufio.NewWriter(targetConn)
+	go proxy(*tw, in.bc.rw.Reader, errCh)
+	go proxy(*in.bc.rw.Writer, targetConn, errCh)
+
+	// Wait
+	for i := 0; i < 2; i++ {
+		e := <-errCh
+		if e != nil {
+			break
+		}
+	}
+}
+
+func (s *Server) serveSocks5(in *inboundConn) {
+	// 如果是socks5协议, 则调用socks5协议库, 若是client模式直接使用tls转发到服务器.
+	if idx := s.upstreamIndex(in); idx >= 0 {
+		s.forwardUpstream(in, idx)
+		return
+	}
+
+	// 没有配置上游服务器地址, 直接作为socks5服务器提供socks5服务.
+	StartSocks5Proxy(in.ID, in.bc.rw, s.auth(), s.dialFunc(in),
+		in.bc.rw.Reader, in.bc.rw.Writer)
+	fmt.Println(in.ID, "- Leave socks5 proxy with client:", in.remote)
+}
+
+func (s *Server) serveSocks4(in *inboundConn) {
+	// socks4/socks4a协议, 处理方式与socks5相同.
+	if idx := s.upstreamIndex(in); idx >= 0 {
+		s.forwardUpstream(in, idx)
+		return
+	}
+
+	StartSocks4Proxy(in.ID, in.bc.rw, s.auth(), s.dialFunc(in),
+		s.bindFunc(in), in.bc.rw.Reader, in.bc.rw.Writer)
+	fmt.Println(in.ID, "- Leave socks4 proxy with client:", in.remote)
+}
+
+func (s *Server) serveHTTP(in *inboundConn) {
+	// http proxy, 若是client模式直接使用tls转发到服务器.
+	if idx := s.upstreamIndex(in); idx >= 0 {
+		s.forwardUpstream(in, idx)
+		return
+	}
+
+	StartHTTPProxy(in.ID, in.bc.rw, s.auth(), s.dialFunc(in),
+		in.bc.rw.Reader, in.bc.rw.Writer)
+	fmt.Println(in.ID, "- Leave http proxy with client:", in.remote)
+}
+
+func (s *Server) serveWebsocket(in *inboundConn) {
+	// 明文websocket只在配置的路径上提供, 其它明文请求按普通http请求处理.
+	if !in.secure && !s.matchWebsocketPath(in) {
+		s.serveHTTP(in)
+		return
+	}
+
+	s.startWSS(in)
+	fmt.Println(in.ID, "- WSS Proxy disconnect...")
+}
+
+// serveTLS 完成tls握手, 再识别其中的wss或https代理请求.
+func (s *Server) serveTLS(in *inboundConn) {
+	fmt.Println(in.ID, "* Start tls connection...")
+
+	// 转换成TLS connection对象.
+	TLSConn := tls.Server(in.bc, ServerTLSConfig)
+
+	// 开始握手.
+	err := TLSConn.Handshake()
+	if err != nil {
+		fmt.Println(in.ID, "tls connection handshake fail", err.Error())
+		return
+	}
+
+	s.serveInbound(&inboundConn{
+		ID:      in.ID,
+		conn:    TLSConn,
+		bc:      newBufferedConn(TLSConn),
+		remote:  in.remote,
+		local:   in.local,
+		secure:  true,
+		proxied: in.proxied,
+	})
+}
+
+// matchPassthrough 返回与ClientHello匹配的透传配置.
+func (s *Server) matchPassthrough(hello *clientHello) *PassthroughConfig {
+	if hello == nil {
+		return nil
+	}
+
+	serverName := normalizeDomain(hello.serverName)
+	for i := range s.config.Passthrough {
+		p := &s.config.Passthrough[i]
+		if p.Target == "" && serverName == "" {
+			continue
+		}
+		if len(p.ServerName) > 0 && !matchServerName(p.ServerName, serverName) {
+			continue
+		}
+		if len(p.ALPN) > 0 && !matchALPN(p.ALPN, hello.alpn) {
+			continue
+		}
+		return p
+	}
+
+	return nil
+}
+
+func matchServerName(patterns []string, serverName string) bool {
+	for _, pattern := range patterns {
+		pattern = normalizeDomain(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(serverName, pattern[1:]) {
+				return true
+			}
+		} else if pattern == serverName {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchALPN(protos []string, offered []string) bool {
+	for _, proto := range protos {
+		for _, v := range offered {
+			if proto == v {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// servePassthrough 不解密tls, 按SNI把连接原样转发到目标.
+func (s *Server) servePassthrough(in *inboundConn) {
+	p := s.matchPassthrough(in.hello)
+
+	target := p.Target
+	if target == "" {
+		target = net.JoinHostPort(in.hello.serverName, "443")
+	}
+
+	host, port, err := parseHostPort(target)
+	if err != nil {
+		fmt.Println(in.ID, "Passthrough invalid target", target, err.Error())
+		return
+	}
+
+	fmt.Println(in.ID, "* Start tls passthrough, sni", in.hello.serverName, "to", target)
+
+	targetConn, err := s.dialFunc(in)(&Metadata{Host: host, Port: port})
+	if err != nil {
+		fmt.Println(in.ID, "Passthrough connect to", target, "error", err.Error())
+		return
+	}
+	defer targetConn.Close()
+
+	relay(in, targetConn)
+	fmt.Println(in.ID, "- Leave tls passthrough with client:", in.remote)
+}
+
+// peekRequestURI 预读http请求行, 返回其中的请求目标.
+func peekRequestURI(reader *bufio.Reader) (string, error) {
+	for n := 1; ; n++ {
+		if n > reader.Size() {
+			return "", bufio.ErrBufferFull
+		}
+		if reader.Buffered() > n {
+			n = reader.Buffered()
+		}
+
+		peek, err := reader.Peek(n)
+		if err != nil {
+			return "", err
+		}
+
+		if i := bytes.IndexByte(peek, '\n'); i >= 0 {
+			fields := strings.Fields(string(peek[:i]))
+			if len(fields) != 3 {
+				return "", fmt.Errorf("invalid request line %q", peek[:i])
+			}
+			return fields[1], nil
+		}
+	}
+}
+
+// matchWebsocketPath 判断明文请求是否为配置路径上的websocket握手.
+func (s *Server) matchWebsocketPath(in *inboundConn) bool {
+	if s.config.Websocket.Path == "" {
+		return false
+	}
+
+	uri, err := peekRequestURI(in.bc.rw.Reader)
+	if err != nil {
+		fmt.Println(in.ID, "Websocket peek request error", err.Error())
+		return false
+	}
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		uri = uri[:i]
+	}
+
+	if uri != s.config.Websocket.Path {
+		return false
+	}
+
+	if err := s.plainWebsocketAllowed(in.remote); err != nil {
+		fmt.Println(in.ID, "Refuse plain websocket from", in.remote, err.Error())
+		return false
+	}
+
+	return true
+}
+
+// plainWebsocketAllowed 检查是否接受来自remote的明文websocket握手, 明文握手无法校验客户端证书,
+// 因此要求客户端证书时不接受; 配置了 Trusted 时只接受可信反向代理转发的明文握手.
+func (s *Server) plainWebsocketAllowed(remote net.Addr) error {
+	if certsConfig.RequireClientCert {
+		return errors.New("client certificate required")
+	}
+	if len(s.trustedForwarders) > 0 && !containsAddr(s.trustedForwarders, remote) {
+		return errors.New("not from a trusted forwarder")
+	}
+
+	return nil
+}
+
+// forwardedFor 连接来自可信反向代理时, 按 X-Real-IP、X-Forwarded-For 返回真实的客户端地址.
+func (s *Server) forwardedFor(remote net.Addr, header http.Header) net.Addr {
+	if !containsAddr(s.trustedForwarders, remote) {
+		return remote
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(header.Get("X-Real-IP"))); ip != nil {
+		return &net.TCPAddr{IP: ip}
+	}
+
+	// 从右向左跳过可信代理, 第一个不可信的地址即客户端地址.
+	var addrs []string
+	for _, v := range header.Values("X-Forwarded-For") {
+		addrs = append(addrs, strings.Split(v, ",")...)
+	}
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(addrs[i]))
+		if ip == nil {
+			break
+		}
+		addr := &net.TCPAddr{IP: ip}
+		if i == 0 || !containsAddr(s.trustedForwarders, addr) {
+			return addr
+		}
+	}
+
+	return remote
+}
@@ -0,0 +1,39 @@
+package wsproxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPlainWebsocketAllowed(t *testing.T) {
+	trusted, err := parseTrustedCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(c CertsConfig) { certsConfig = c }(certsConfig)
+
+	forwarder := &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}
+	other := &net.TCPAddr{IP: net.ParseIP("203.0.113.7")}
+
+	tests := []struct {
+		trusted           []*net.IPNet
+		requireClientCert bool
+		remote            net.Addr
+		allowed           bool
+	}{
+		{nil, false, other, true},
+		{trusted, false, forwarder, true},
+		{trusted, false, other, false},
+		{trusted, false, nil, false},
+		{nil, true, other, false},
+		{trusted, true, forwarder, false},
+	}
+
+	for i, tt := range tests {
+		s := &Server{trustedForwarders: tt.trusted}
+		certsConfig.RequireClientCert = tt.requireClientCert
+		if err := s.plainWebsocketAllowed(tt.remote); (err == nil) != tt.allowed {
+			t.Errorf("case %d: plainWebsocketAllowed(%v) = %v, want allowed %v", i, tt.remote, err, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,502 @@
+package wsproxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gitee.com/jackarain/wsproxy/websocket"
+)
+
+var (
+	// ErrRejected 请求被路由规则拒绝.
+	ErrRejected = errors.New("rejected by rule")
+
+	// ErrBindNotDirect BIND命令只支持直连路由.
+	ErrBindNotDirect = errors.New("bind is only supported on direct routes")
+)
+
+// DialFunc 根据请求信息建立到目标的出站连接.
+type DialFunc func(m *Metadata) (net.Conn, error)
+
+// BindFunc 根据请求信息在本机监听, 用于接受目标主机的反向连接.
+type BindFunc func(m *Metadata) (net.Listener, error)
+
+// socksError 上游socks5服务器返回的错误应答码.
+type socksError byte
+
+var socksErrorText = map[socksError]string{
+	1: "general socks server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func (e socksError) Error() string {
+	if text, found := socksErrorText[e]; found {
+		return "upstream: " + text
+	}
+	return fmt.Sprintf("upstream: socks5 reply error %d", byte(e))
+}
+
+// newClientConn 在已连接到上游服务器的websocket上创建字节流, 用于在隧道上进行socks5握手及转发,
+// encoding 为旧版本的编码, compression 及 deflate 为握手时协商的压缩方式.
+func newClientConn(c net.Conn, encoding, compression string, deflate *websocket.DeflateParams) *websocket.Conn {
+	if compression == encodingNone {
+		compression = ""
+	}
+
+	rw := io.ReadWriter(c)
+	conn := websocket.NewConn(c, &websocket.Websocket{
+		Conn:              &rw,
+		Encoding:          encoding,
+		MaxFrameSize:      MaxFrameSize,
+		MaxMessageSize:    MaxMessageSize,
+		Client:            true,
+		Compression:       compression,
+		Deflate:           deflate,
+		CompressionLevel:  CompressionLevel,
+		AlwaysCompress:    AlwaysCompress,
+		MaxInflationRatio: MaxInflationRatio,
+	})
+	conn.KeepAlive(PingInterval, PongTimeout)
+
+	return conn
+}
+
+// socks5Connect 作为socks5客户端在conn上发起CONNECT请求.
+func socks5Connect(conn net.Conn, user *url.Userinfo, host string, port uint16) error {
+	// |VER | NMETHODS | METHODS  |
+	method := socks5AuthNone
+	if user != nil {
+		method = socks5Auth
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+
+	// |VER | METHOD |
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version || reply[1] != method {
+		return fmt.Errorf("socks5 method %d not accepted", method)
+	}
+
+	if method == socks5Auth {
+		passwd, _ := user.Password()
+		buf := []byte{1, byte(len(user.Username()))}
+		buf = append(buf, user.Username()...)
+		buf = append(buf, byte(len(passwd)))
+		buf = append(buf, passwd...)
+		if _, err := conn.Write(buf); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("socks5 auth failed")
+		}
+	}
+
+	// |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+	buf := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, socks5AtypIpv4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, socks5AtypIpv6)
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		buf = append(buf, socks5AtypDomainName, byte(len(host)))
+		buf = append(buf, host...)
+	}
+	buf = append(buf, byte(port>>8), byte(port))
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+
+	//  |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		return socksError(header[1])
+	}
+
+	addrLen := 0
+	switch header[3] {
+	case socks5AtypIpv4:
+		addrLen = 4
+	case socks5AtypIpv6:
+		addrLen = 16
+	case socks5AtypDomainName:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		addrLen = int(l[0])
+	default:
+		return fmt.Errorf("socks5 reply atyp invalid %d", header[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, addrLen+2)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// httpConnect 作为http代理客户端在conn上发起CONNECT请求.
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) (net.Conn, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if user != nil {
+		passwd, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + passwd))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	req += "\r\n"
+
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+
+	bc := newBufferedConn(conn)
+	resp, err := http.ReadResponse(bc.rw.Reader, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http proxy connect %s: %s", addr, resp.Status)
+	}
+
+	return bc, nil
+}
+
+// OutboundConfig 命名出站配置, URL 为出站地址, Via 为连接该出站本身时使用的前一跳出站名称.
+type OutboundConfig struct {
+	URL string `json:"URL"`
+	Via string `json:"Via"`
+}
+
+// outboundBuilder 按名称创建出站, 处理Via链并检测循环引用.
+type outboundBuilder struct {
+	configs   map[string]OutboundConfig
+	outbounds map[string]Dialer
+	building  map[string]bool
+
+	// 所有出站服务器的主机名, 解析时不能再经过出站自身.
+	hosts []string
+}
+
+// newDialer 创建出站并记录其服务器主机名.
+func (b *outboundBuilder) newDialer(rawurl string, forward Dialer) (Dialer, error) {
+	d, err := NewDialer(rawurl, forward)
+	if err != nil {
+		return nil, err
+	}
+
+	if u, err := url.Parse(rawurl); err == nil && u.Hostname() != "" {
+		b.hosts = append(b.hosts, u.Hostname())
+	}
+
+	return d, nil
+}
+
+// build 返回名称对应的出站, 不是命名出站时按url解析.
+func (b *outboundBuilder) build(name string) (Dialer, error) {
+	if d, found := b.outbounds[name]; found {
+		return d, nil
+	}
+
+	config, found := b.configs[name]
+	if !found {
+		d, err := b.newDialer(name, nil)
+		if err != nil {
+			return nil, err
+		}
+		b.outbounds[name] = d
+		return d, nil
+	}
+
+	if b.building[name] {
+		return nil, fmt.Errorf("outbound %q via loop", name)
+	}
+	b.building[name] = true
+
+	var forward Dialer
+	if config.Via != "" {
+		var err error
+		forward, err = b.build(config.Via)
+		if err != nil {
+			return nil, fmt.Errorf("outbound %q: %v", name, err)
+		}
+	}
+
+	d, err := b.newDialer(config.URL, forward)
+	if err != nil {
+		return nil, fmt.Errorf("outbound %q: %v", name, err)
+	}
+	b.outbounds[name] = d
+
+	return d, nil
+}
+
+func (b *outboundBuilder) group(name string, servers []string) (Dialer, error) {
+	g := &groupDialer{
+		name: name,
+	}
+
+	for _, server := range servers {
+		d, err := b.build(server)
+		if err != nil {
+			return nil, err
+		}
+		g.dialers = append(g.dialers, d)
+	}
+
+	return g, nil
+}
+
+// isLegacyUpstream UpstreamProxyServer 为不带scheme的 host:port 时, 保持原有的原样转发方式.
+func isLegacyUpstream(config *Configuration) bool {
+	if config.UpstreamProxyServer == "" || strings.Contains(config.UpstreamProxyServer, "://") {
+		return false
+	}
+	_, found := config.Outbounds[config.UpstreamProxyServer]
+	return !found
+}
+
+// upstreamProxyDialer 创建UpstreamProxyServer出站, 需要发送PROXY协议头时单独创建, 不与同名出站共用.
+func (s *Server) upstreamProxyDialer(b *outboundBuilder, config *Configuration) (Dialer, error) {
+	version := config.ProxyProtocol.Send
+	if version == 0 {
+		return b.build(config.UpstreamProxyServer)
+	}
+
+	rawurl := config.UpstreamProxyServer
+	if outbound, found := config.Outbounds[rawurl]; found {
+		if outbound.Via != "" {
+			return nil, fmt.Errorf("outbound %q: PROXY protocol header can not be sent via %q", rawurl, outbound.Via)
+		}
+		rawurl = outbound.URL
+	}
+
+	return b.newDialer(rawurl, &proxyHeaderDialer{
+		version: version,
+		forward: Direct,
+	})
+}
+
+// initOutbounds 根据配置创建命名出站、上游服务器分组及默认出站.
+func (s *Server) initOutbounds(config *Configuration) error {
+	// 直连出站需要最先创建, 其它出站默认经由它连接代理服务器.
+	direct, err := NewDirectDialer(config.Direct)
+	if err != nil {
+		return err
+	}
+	Direct = direct
+
+	b := &outboundBuilder{
+		configs:   config.Outbounds,
+		outbounds: make(map[string]Dialer),
+		building:  make(map[string]bool),
+	}
+
+	for name := range config.Outbounds {
+		if _, err := b.build(name); err != nil {
+			return err
+		}
+	}
+
+	s.groups = make(map[string]Dialer)
+	s.routes = make(map[*Rule]Dialer)
+	g, err := b.group("", config.Servers)
+	if err != nil {
+		return err
+	}
+	s.groups[""] = g
+	for name, servers := range config.UpstreamGroups {
+		g, err := b.group(name, servers)
+		if err != nil {
+			return err
+		}
+		s.groups[name] = g
+	}
+
+	for _, rule := range s.router.rules {
+		switch rule.Action {
+		case ActionUpstream:
+			if _, found := s.groups[rule.Upstream]; !found {
+				return fmt.Errorf("unknown upstream group %q", rule.Upstream)
+			}
+		case ActionProxy:
+			if _, err := b.build(rule.Upstream); err != nil {
+				return err
+			}
+		case ActionDirect:
+			// 规则指定了出口网卡或源地址时使用独立的直连出站.
+			if rule.Direct.Interface == "" && len(rule.Direct.BindAddress) == 0 {
+				continue
+			}
+			routeConfig := config.Direct
+			if rule.Direct.Interface != "" {
+				routeConfig.Interface = rule.Direct.Interface
+			}
+			if len(rule.Direct.BindAddress) > 0 {
+				routeConfig.BindAddress = rule.Direct.BindAddress
+			}
+			d, err := NewDirectDialer(routeConfig)
+			if err != nil {
+				return err
+			}
+			s.routes[rule] = d
+		}
+	}
+
+	// 未命中任何规则时, client模式走上游服务器, server模式经UpstreamProxyServer或直连.
+	s.defaultDialer = Direct
+	if len(config.Servers) > 0 {
+		s.defaultDialer = s.groups[""]
+	} else if config.UpstreamProxyServer != "" && !isLegacyUpstream(config) {
+		s.defaultDialer, err = s.upstreamProxyDialer(b, config)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.outbounds = b.outbounds
+
+	// 创建域名解析器, Via 可以是上游服务器分组名(upstream 表示Servers)或出站.
+	var via Dialer
+	if name := config.DNS.Via; name != "" {
+		if name == ActionUpstream {
+			name = ""
+		}
+		if g, found := s.groups[name]; found {
+			via = g
+		} else if via, err = b.build(config.DNS.Via); err != nil {
+			return err
+		}
+	}
+
+	resolver, err := NewResolver(config.DNS, via)
+	if err != nil {
+		return err
+	}
+	for _, host := range b.hosts {
+		resolver.AddBootstrap(host)
+	}
+	DefaultResolver = resolver
+
+	return nil
+}
+
+// route 按路由规则为请求选择出站, 同时返回用于日志的路由名称.
+func (s *Server) route(m *Metadata) (Dialer, string) {
+	dialer := s.defaultDialer
+	route := "default"
+
+	if rule := s.router.Match(m); rule != nil {
+		route = strings.TrimSpace(rule.Action + " " + rule.Upstream)
+		switch rule.Action {
+		case ActionDirect:
+			dialer = Direct
+			if d, found := s.routes[rule]; found {
+				dialer = d
+			}
+		case ActionReject:
+			dialer = Reject
+		case ActionUpstream:
+			dialer = s.groups[rule.Upstream]
+		case ActionProxy:
+			dialer = s.outbounds[rule.Upstream]
+		}
+	}
+
+	return dialer, route
+}
+
+// dial 按路由规则选择出站连接目标.
+func (s *Server) dial(m *Metadata) (net.Conn, error) {
+	dialer, route := s.route(m)
+
+	fmt.Println(m.ID, "Route", m.Address(), "user", m.User, "->", route)
+
+	return dialer.Dial(m)
+}
+
+// bind 为BIND命令在本机监听, 只有直连路由才能接受目标主机的反向连接.
+func (s *Server) bind(m *Metadata) (net.Listener, error) {
+	dialer, route := s.route(m)
+
+	fmt.Println(m.ID, "Route bind", m.Address(), "user", m.User, "->", route)
+
+	if dialer == Reject {
+		return nil, ErrRejected
+	}
+	d, ok := dialer.(*directDialer)
+	if !ok {
+		return nil, ErrBindNotDirect
+	}
+
+	return d.listen(net.ParseIP(m.Host))
+}
+
+// dialFunc 返回绑定入站连接id和地址的DialFunc.
+func (s *Server) dialFunc(in *inboundConn) DialFunc {
+	return func(m *Metadata) (net.Conn, error) {
+		m.ID = in.ID
+		m.Source = in.remote
+		m.Local = in.local
+		return s.dial(m)
+	}
+}
+
+// bindFunc 返回绑定入站连接id和地址的BindFunc.
+func (s *Server) bindFunc(in *inboundConn) BindFunc {
+	return func(m *Metadata) (net.Listener, error) {
+		m.ID = in.ID
+		m.Source = in.remote
+		m.Local = in.local
+		return s.bind(m)
+	}
+}
+
+// parseHostPort 把 host:port 形式的地址拆分为主机和端口.
+func parseHostPort(addr string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := parsePort(portStr)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return host, port, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint16(port), nil
+}
@@ -0,0 +1,257 @@
+package wsproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	proxyV1MaxLength = 107
+
+	proxyV2CmdLocal = 0x0
+	proxyV2CmdProxy = 0x1
+
+	proxyV2FamTCP4 = 0x11
+	proxyV2FamTCP6 = 0x21
+)
+
+var errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+// ProxyProtocolConfig PROXY protocol配置, 用于在HAProxy等负载均衡之后获取真实的客户端地址.
+type ProxyProtocolConfig struct {
+	// Trusted 允许发送PROXY协议头的来源ip或网段, 为空时不接受PROXY协议头.
+	Trusted []string `json:"Trusted"`
+
+	// Send 连接UpstreamProxyServer时发送的PROXY协议头版本, 1或2, 为0时不发送.
+	Send int `json:"Send"`
+}
+
+// parseTrustedCIDRs 解析可信的负载均衡或反向代理地址.
+func parseTrustedCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var trusted []*net.IPNet
+	for _, v := range cidrs {
+		ipnet, err := parseCIDR(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		trusted = append(trusted, ipnet)
+	}
+
+	return trusted, nil
+}
+
+// containsAddr 判断tcp地址是否属于给定的网段.
+func containsAddr(nets []*net.IPNet, addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, ipnet := range nets {
+		if ipnet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveProxyProtocol 读取可信来源发送的PROXY协议头, 替换客户端地址后继续识别后面的协议.
+func (s *Server) serveProxyProtocol(in *inboundConn) {
+	if !containsAddr(s.trustedProxies, in.remote) {
+		fmt.Println(in.ID, "- PROXY protocol header from untrusted", in.remote)
+		return
+	}
+
+	src, dst, err := readProxyHeader(in.bc.rw.Reader)
+	if err != nil {
+		fmt.Println(in.ID, "- PROXY protocol header from", in.remote, "error", err.Error())
+		return
+	}
+
+	// LOCAL命令或UNKNOWN协议时保留原来的地址.
+	if src != nil && dst != nil {
+		fmt.Println(in.ID, "PROXY protocol from", in.remote, "client", src)
+		in.remote = src
+		in.local = dst
+	}
+	in.proxied = true
+
+	s.serveInbound(in)
+}
+
+// readProxyHeader 读取v1或v2格式的PROXY协议头, 返回客户端地址和目的地址.
+func readProxyHeader(reader *bufio.Reader) (src, dst net.Addr, err error) {
+	if peekPrefix(reader, proxyV2Signature) {
+		return readProxyHeaderV2(reader)
+	}
+
+	return readProxyHeaderV1(reader)
+}
+
+// readProxyHeaderV1 PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n
+func readProxyHeaderV1(reader *bufio.Reader) (src, dst net.Addr, err error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(line) > proxyV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, nil, errInvalidProxyHeader
+		}
+	default:
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	srcIP := net.ParseIP(fields[2])
+	dstIP := net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)},
+		&net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// readProxyHeaderV2 读取二进制格式的PROXY协议头, 忽略其中的TLV.
+func readProxyHeaderV2(reader *bufio.Reader) (src, dst net.Addr, err error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, err
+	}
+
+	verCmd := header[12]
+	fam := header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	if verCmd>>4 != 2 {
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, nil, err
+	}
+
+	switch verCmd & 0x0F {
+	case proxyV2CmdLocal:
+		return nil, nil, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	// 只使用ipv4/ipv6地址, 其它地址族按LOCAL处理.
+	ipLen := 0
+	switch fam >> 4 {
+	case 0x1:
+		ipLen = net.IPv4len
+	case 0x2:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+
+	if len(payload) < ipLen*2+4 {
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	srcIP := net.IP(payload[:ipLen])
+	dstIP := net.IP(payload[ipLen : ipLen*2])
+	srcPort := binary.BigEndian.Uint16(payload[ipLen*2:])
+	dstPort := binary.BigEndian.Uint16(payload[ipLen*2+2:])
+
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)},
+		&net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// makeProxyHeader 生成PROXY协议头, 地址不是tcp地址时生成 UNKNOWN/LOCAL 头.
+func makeProxyHeader(version int, src, dst net.Addr) []byte {
+	srcAddr, ok1 := src.(*net.TCPAddr)
+	dstAddr, ok2 := dst.(*net.TCPAddr)
+	known := ok1 && ok2
+
+	// 地址族不一致时都使用ipv6表示.
+	srcIP, dstIP := net.IP(nil), net.IP(nil)
+	ipv4 := false
+	if known {
+		srcIP, dstIP = srcAddr.IP.To4(), dstAddr.IP.To4()
+		ipv4 = srcIP != nil && dstIP != nil
+		if !ipv4 {
+			srcIP, dstIP = srcAddr.IP.To16(), dstAddr.IP.To16()
+		}
+	}
+
+	if version == 1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		proto := "TCP6"
+		if ipv4 {
+			proto = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+			proto, srcIP, dstIP, srcAddr.Port, dstAddr.Port))
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write(proxyV2Signature)
+	if !known {
+		buf.Write([]byte{0x20 | proxyV2CmdLocal, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	fam := byte(proxyV2FamTCP6)
+	if ipv4 {
+		fam = proxyV2FamTCP4
+	}
+	buf.Write([]byte{0x20 | proxyV2CmdProxy, fam})
+	binary.Write(buf, binary.BigEndian, uint16(len(srcIP)*2+4))
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	binary.Write(buf, binary.BigEndian, uint16(srcAddr.Port))
+	binary.Write(buf, binary.BigEndian, uint16(dstAddr.Port))
+
+	return buf.Bytes()
+}
+
+// proxyHeaderDialer 连接建立后先发送PROXY协议头, 用于把客户端地址传递给UpstreamProxyServer.
+type proxyHeaderDialer struct {
+	version int
+	forward Dialer
+}
+
+func (d *proxyHeaderDialer) Dial(m *Metadata) (net.Conn, error) {
+	conn, err := d.forward.Dial(m)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(makeProxyHeader(d.version, m.Source, m.Local)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,582 @@
+package wsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// PreferIPv4 优先使用ipv4地址.
+	PreferIPv4 = "ipv4"
+
+	// PreferIPv6 优先使用ipv6地址.
+	PreferIPv6 = "ipv6"
+
+	// OnlyIPv4 只解析ipv4地址.
+	OnlyIPv4 = "ipv4-only"
+
+	// OnlyIPv6 只解析ipv6地址.
+	OnlyIPv6 = "ipv6-only"
+
+	dnsTimeout     = 5 * time.Second
+	dnsNegativeTTL = 10 * time.Second
+	dnsCacheLimit  = 4096
+)
+
+var (
+	// DefaultResolver 直连出站及路由规则使用的域名解析器, 默认使用系统解析.
+	DefaultResolver = &Resolver{}
+
+	errNoAddress = errors.New("no such host")
+
+	// timeNow 缓存使用的时钟.
+	timeNow = time.Now
+)
+
+// DNSConfig 域名解析配置.
+type DNSConfig struct {
+	// Servers 支持 8.8.8.8、udp://8.8.8.8:53、tcp://8.8.8.8:53、tls://1.1.1.1:853、https://dns.google/dns-query.
+	Servers []string            `json:"Servers"`
+	Hosts   map[string][]string `json:"Hosts"`
+	Prefer  string              `json:"Prefer"`
+
+	// Via 通过上游服务器分组或出站查询, 查询一律使用tcp, 避免本地泄露dns请求.
+	Via string `json:"Via"`
+}
+
+type dnsServer struct {
+	scheme string
+	addr   string
+	url    string
+}
+
+type dnsCacheEntry struct {
+	ips    []net.IP
+	err    error
+	expire time.Time
+}
+
+// Resolver 域名解析器, 支持静态hosts、多种dns协议、ipv4/ipv6优先级及按TTL缓存.
+type Resolver struct {
+	servers []dnsServer
+	hosts   map[string][]net.IP
+	prefer  string
+	dialer  Dialer
+	client  *http.Client
+
+	// bootstrap 中的域名(上游服务器、dns服务器自身)总是使用系统解析, 避免循环依赖.
+	bootstrap map[string]bool
+
+	// tlsConfig dns over tls/https 使用的tls配置, 为nil时使用系统证书.
+	tlsConfig *tls.Config
+
+	mu    sync.Mutex
+	cache map[string]dnsCacheEntry
+}
+
+func parseDNSServer(s string) (dnsServer, error) {
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return dnsServer{}, err
+	}
+
+	server := dnsServer{
+		scheme: strings.ToLower(u.Scheme),
+		url:    s,
+	}
+
+	switch server.scheme {
+	case "udp", "tcp":
+		server.addr = hostPortDefault(u, "53")
+	case "tls":
+		server.addr = hostPortDefault(u, "853")
+	case "https":
+		server.addr = hostPortDefault(u, "443")
+	default:
+		return dnsServer{}, fmt.Errorf("unsupported dns server %q", s)
+	}
+
+	return server, nil
+}
+
+// NewResolver 根据配置创建解析器, dialer为nil时直连dns服务器.
+func NewResolver(config DNSConfig, dialer Dialer) (*Resolver, error) {
+	r := &Resolver{
+		hosts:     make(map[string][]net.IP),
+		prefer:    strings.ToLower(config.Prefer),
+		dialer:    dialer,
+		bootstrap: make(map[string]bool),
+		cache:     make(map[string]dnsCacheEntry),
+	}
+
+	switch r.prefer {
+	case "", PreferIPv4, PreferIPv6, OnlyIPv4, OnlyIPv6:
+	default:
+		return nil, fmt.Errorf("unknown dns prefer %q", config.Prefer)
+	}
+
+	for _, s := range config.Servers {
+		server, err := parseDNSServer(s)
+		if err != nil {
+			return nil, err
+		}
+		r.servers = append(r.servers, server)
+
+		host, _, _ := net.SplitHostPort(server.addr)
+		r.AddBootstrap(host)
+	}
+
+	// dns over https 复用同一个http客户端.
+	r.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: r.dialServer,
+		},
+	}
+
+	for name, addrs := range config.Hosts {
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid hosts address %q for %s", addr, name)
+			}
+			r.hosts[normalizeDomain(name)] = append(r.hosts[normalizeDomain(name)], ip)
+		}
+	}
+
+	return r, nil
+}
+
+// AddBootstrap 指定域名总是使用系统解析.
+func (r *Resolver) AddBootstrap(host string) {
+	if host == "" || net.ParseIP(host) != nil {
+		return
+	}
+	if r.bootstrap == nil {
+		r.bootstrap = make(map[string]bool)
+	}
+	r.bootstrap[normalizeDomain(host)] = true
+}
+
+// sortIPs 按优先级排序并过滤地址.
+func (r *Resolver) sortIPs(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	switch r.prefer {
+	case PreferIPv6:
+		return append(v6, v4...)
+	case OnlyIPv4:
+		return v4
+	case OnlyIPv6:
+		return v6
+	}
+
+	return append(v4, v6...)
+}
+
+// LookupIP 解析域名, 返回按优先级排序的ip地址.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	name := normalizeDomain(host)
+	ips, found := r.hosts[name]
+	if !found {
+		var err error
+		if len(r.servers) == 0 || r.bootstrap[name] {
+			ips, err = lookupSystem(ctx, name)
+		} else {
+			ips, err = r.lookup(ctx, name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// hosts中的地址同样可能被 Prefer 全部过滤掉.
+	ips = r.sortIPs(ips)
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: errNoAddress.Error(), Name: host, IsNotFound: true}
+	}
+
+	return ips, nil
+}
+
+func lookupSystem(ctx context.Context, name string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+
+	return ips, nil
+}
+
+// lookup 并发查询A和AAAA记录.
+func (r *Resolver) lookup(ctx context.Context, name string) ([]net.IP, error) {
+	var types []dnsmessage.Type
+	if r.prefer != OnlyIPv6 {
+		types = append(types, dnsmessage.TypeA)
+	}
+	if r.prefer != OnlyIPv4 {
+		types = append(types, dnsmessage.TypeAAAA)
+	}
+
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	results := make(chan result, len(types))
+	for _, qtype := range types {
+		go func(qtype dnsmessage.Type) {
+			ips, err := r.lookupType(ctx, name, qtype)
+			results <- result{ips, err}
+		}(qtype)
+	}
+
+	var ips []net.IP
+	var err error
+	for range types {
+		res := <-results
+		if res.err != nil {
+			err = res.err
+			continue
+		}
+		ips = append(ips, res.ips...)
+	}
+
+	if len(ips) > 0 {
+		return ips, nil
+	}
+
+	return nil, err
+}
+
+func (r *Resolver) lookupType(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, error) {
+	key := name + "/" + qtype.String()
+
+	r.mu.Lock()
+	entry, found := r.cache[key]
+	r.mu.Unlock()
+	if found && timeNow().Before(entry.expire) {
+		return entry.ips, entry.err
+	}
+
+	ips, ttl, err := r.query(ctx, name, qtype)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+		// 域名不存在时短暂缓存.
+		ttl = dnsNegativeTTL
+	} else if len(ips) == 0 {
+		// 没有该类型的记录时同样短暂缓存.
+		ttl = dnsNegativeTTL
+	}
+
+	if ttl > 0 {
+		r.mu.Lock()
+		if len(r.cache) >= dnsCacheLimit {
+			r.purge()
+		}
+		r.cache[key] = dnsCacheEntry{
+			ips:    ips,
+			err:    err,
+			expire: timeNow().Add(ttl),
+		}
+		r.mu.Unlock()
+	}
+
+	return ips, err
+}
+
+// purge 清理过期缓存, 仍然过多时全部清空.
+func (r *Resolver) purge() {
+	now := timeNow()
+	for key, entry := range r.cache {
+		if now.After(entry.expire) {
+			delete(r.cache, key)
+		}
+	}
+	if len(r.cache) >= dnsCacheLimit {
+		r.cache = make(map[string]dnsCacheEntry)
+	}
+}
+
+// query 依次向dns服务器查询, 返回地址及最小TTL.
+func (r *Resolver) query(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	id := uint16(rand.Uint32())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               id,
+		RecursionDesired: true,
+	})
+	b.EnableCompression()
+
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	err = b.Question(dnsmessage.Question{
+		Name:  qname,
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, server := range r.servers {
+		qctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+		var resp []byte
+		resp, err = r.exchange(qctx, server, msg)
+		cancel()
+		if err != nil {
+			err = fmt.Errorf("dns server %s: %v", server.url, err)
+			continue
+		}
+
+		var ips []net.IP
+		var ttl time.Duration
+		ips, ttl, err = parseDNSResponse(resp, id, name)
+		if err == nil {
+			return ips, ttl, nil
+		}
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, 0, err
+		}
+	}
+
+	return nil, 0, err
+}
+
+func parseDNSResponse(resp []byte, id uint16, name string) ([]net.IP, time.Duration, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	if header.ID != id || !header.Response {
+		return nil, 0, fmt.Errorf("dns response mismatch")
+	}
+	if header.RCode == dnsmessage.RCodeNameError {
+		return nil, 0, &net.DNSError{Err: errNoAddress.Error(), Name: name, IsNotFound: true}
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("dns response %s", header.RCode.String())
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch h.Type {
+		case dnsmessage.TypeA:
+			res, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(res.A[:]))
+		case dnsmessage.TypeAAAA:
+			res, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(res.AAAA[:]))
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+
+		if ttl == 0 || h.TTL < ttl {
+			ttl = h.TTL
+		}
+	}
+
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// dialServer 连接dns服务器, 配置了Via时通过上游出站连接.
+func (r *Resolver) dialServer(ctx context.Context, network, addr string) (net.Conn, error) {
+	if r.dialer == nil {
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+
+	host, port, err := parseHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.dialer.Dial(&Metadata{
+		Host: host,
+		Port: port,
+	})
+}
+
+func (r *Resolver) exchange(ctx context.Context, server dnsServer, msg []byte) ([]byte, error) {
+	switch server.scheme {
+	case "udp":
+		// 通过上游出站查询时只能使用tcp.
+		if r.dialer != nil {
+			return r.exchangeStream(ctx, server, msg, false)
+		}
+		resp, err := r.exchangeUDP(ctx, server, msg)
+		if err != nil {
+			return nil, err
+		}
+		// 应答被截断时使用tcp重试.
+		if len(resp) > 2 && resp[2]&0x02 != 0 {
+			return r.exchangeStream(ctx, server, msg, false)
+		}
+		return resp, nil
+	case "tcp":
+		return r.exchangeStream(ctx, server, msg, false)
+	case "tls":
+		return r.exchangeStream(ctx, server, msg, true)
+	case "https":
+		return r.exchangeHTTPS(ctx, server, msg)
+	}
+
+	return nil, fmt.Errorf("unsupported dns server %q", server.url)
+}
+
+func (r *Resolver) exchangeUDP(ctx context.Context, server dnsServer, msg []byte) ([]byte, error) {
+	conn, err := r.dialServer(ctx, "udp", server.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+func (r *Resolver) exchangeStream(ctx context.Context, server dnsServer, msg []byte, useTLS bool) ([]byte, error) {
+	conn, err := r.dialServer(ctx, "tcp", server.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if useTLS {
+		host, _, _ := net.SplitHostPort(server.addr)
+		config := &tls.Config{}
+		if r.tlsConfig != nil {
+			config = r.tlsConfig.Clone()
+		}
+		config.ServerName = host
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	// tcp方式的dns消息前有2字节长度.
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(buf[:2]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (r *Resolver) exchangeHTTPS(ctx context.Context, server dnsServer, msg []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, server.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh response %s", resp.Status)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+}
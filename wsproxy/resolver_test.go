@@ -0,0 +1,374 @@
+package wsproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS 测试用的dns服务器, 按域名返回固定的记录并统计每种查询的次数.
+type fakeDNS struct {
+	ttl uint32
+
+	mu      sync.Mutex
+	records map[string][]net.IP
+	queries map[string]int
+}
+
+func newFakeDNS(ttl uint32) *fakeDNS {
+	return &fakeDNS{
+		ttl: ttl,
+		records: map[string][]net.IP{
+			"dual.test.": {net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+			"v6.test.":   {net.ParseIP("2001:db8::2")},
+		},
+		queries: make(map[string]int),
+	}
+}
+
+func (f *fakeDNS) count(name string, qtype dnsmessage.Type) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queries[name+"/"+qtype.String()]
+}
+
+// answer 根据查询生成应答, 不存在的域名返回NXDOMAIN.
+func (f *fakeDNS) answer(t *testing.T, query []byte) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		t.Errorf("parse query: %v", err)
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		t.Errorf("parse question: %v", err)
+		return nil
+	}
+
+	name := strings.ToLower(q.Name.String())
+	f.mu.Lock()
+	f.queries[strings.TrimSuffix(name, ".")+"/"+q.Type.String()]++
+	ips, found := f.records[name]
+	f.mu.Unlock()
+
+	rh := dnsmessage.Header{ID: header.ID, Response: true, RecursionDesired: true}
+	if !found {
+		rh.RCode = dnsmessage.RCodeNameError
+	}
+
+	b := dnsmessage.NewBuilder(nil, rh)
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	rr := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: f.ttl}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			var a dnsmessage.AResource
+			copy(a.A[:], ip4)
+			b.AResource(rr, a)
+		} else if ip.To4() == nil && q.Type == dnsmessage.TypeAAAA {
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip)
+			b.AAAAResource(rr, aaaa)
+		}
+	}
+
+	resp, err := b.Finish()
+	if err != nil {
+		t.Errorf("build response: %v", err)
+	}
+	return resp
+}
+
+func (f *fakeDNS) serveUDP(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(f.answer(t, buf[:n]), addr)
+		}
+	}()
+
+	return "udp://" + conn.LocalAddr().String()
+}
+
+func (f *fakeDNS) serveStream(t *testing.T, l net.Listener) {
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					var size [2]byte
+					if _, err := io.ReadFull(conn, size[:]); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(size[:]))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					resp := f.answer(t, query)
+					binary.BigEndian.PutUint16(size[:], uint16(len(resp)))
+					conn.Write(append(size[:], resp...))
+				}
+			}(conn)
+		}
+	}()
+}
+
+func (f *fakeDNS) serveTCP(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.serveStream(t, l)
+
+	return "tcp://" + l.Addr().String()
+}
+
+// serveTLS 使用 httptest 的证书, 该证书包含 127.0.0.1.
+func (f *fakeDNS) serveTLS(t *testing.T, cert tls.Certificate) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.serveStream(t, l)
+
+	return "tls://" + l.Addr().String()
+}
+
+func (f *fakeDNS) serveHTTPS(t *testing.T) *httptest.Server {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(f.answer(t, query))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// newTestResolver 创建只使用server的解析器, https为dns over tls/https使用的测试服务器.
+func newTestResolver(t *testing.T, server, prefer string, hosts map[string][]string, https *httptest.Server) *Resolver {
+	r, err := NewResolver(DNSConfig{
+		Servers: []string{server},
+		Prefer:  prefer,
+		Hosts:   hosts,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if https != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(https.Certificate())
+		r.tlsConfig = &tls.Config{RootCAs: pool}
+		r.client.Transport.(*http.Transport).TLSClientConfig = r.tlsConfig
+	}
+
+	return r
+}
+
+// fakeClock 替换缓存使用的时钟.
+func fakeClock(t *testing.T) func(time.Duration) {
+	now := time.Now()
+	var mu sync.Mutex
+	timeNow = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	t.Cleanup(func() { timeNow = time.Now })
+
+	return func(d time.Duration) {
+		mu.Lock()
+		now = now.Add(d)
+		mu.Unlock()
+	}
+}
+
+func equalIPs(got []net.IP, want ...string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if !got[i].Equal(net.ParseIP(want[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+func TestResolverProtocols(t *testing.T) {
+	f := newFakeDNS(60)
+	https := f.serveHTTPS(t)
+
+	servers := map[string]string{
+		"udp":   f.serveUDP(t),
+		"tcp":   f.serveTCP(t),
+		"tls":   f.serveTLS(t, https.TLS.Certificates[0]),
+		"https": https.URL + "/dns-query",
+	}
+
+	for scheme, server := range servers {
+		t.Run(scheme, func(t *testing.T) {
+			r := newTestResolver(t, server, "", nil, https)
+
+			ips, err := r.LookupIP(context.Background(), "dual.test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalIPs(ips, "192.0.2.1", "2001:db8::1") {
+				t.Fatalf("LookupIP = %v", ips)
+			}
+
+			_, err = r.LookupIP(context.Background(), "missing.test")
+			if !isNotFound(err) {
+				t.Fatalf("LookupIP missing.test error = %v, want not found", err)
+			}
+		})
+	}
+}
+
+func TestResolverTTL(t *testing.T) {
+	advance := fakeClock(t)
+	f := newFakeDNS(60)
+	r := newTestResolver(t, f.serveUDP(t), "", nil, nil)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := r.LookupIP(ctx, "dual.test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := f.count("dual.test", dnsmessage.TypeA); n != 1 {
+		t.Fatalf("A queries before expiry = %d, want 1", n)
+	}
+
+	advance(59 * time.Second)
+	r.LookupIP(ctx, "dual.test")
+	if n := f.count("dual.test", dnsmessage.TypeA); n != 1 {
+		t.Fatalf("A queries within ttl = %d, want 1", n)
+	}
+
+	advance(2 * time.Second)
+	if _, err := r.LookupIP(ctx, "dual.test"); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count("dual.test", dnsmessage.TypeA); n != 2 {
+		t.Fatalf("A queries after expiry = %d, want 2", n)
+	}
+}
+
+func TestResolverNegativeCache(t *testing.T) {
+	advance := fakeClock(t)
+	f := newFakeDNS(60)
+	r := newTestResolver(t, f.serveTCP(t), "", nil, nil)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.LookupIP(ctx, "missing.test"); !isNotFound(err) {
+			t.Fatalf("LookupIP error = %v, want not found", err)
+		}
+	}
+	if n := f.count("missing.test", dnsmessage.TypeA); n != 1 {
+		t.Fatalf("queries for cached NXDOMAIN = %d, want 1", n)
+	}
+
+	// 没有A记录的域名同样短暂缓存.
+	for i := 0; i < 2; i++ {
+		if _, err := r.LookupIP(ctx, "v6.test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := f.count("v6.test", dnsmessage.TypeA); n != 1 {
+		t.Fatalf("queries for empty answer = %d, want 1", n)
+	}
+
+	advance(dnsNegativeTTL + time.Second)
+	r.LookupIP(ctx, "missing.test")
+	if n := f.count("missing.test", dnsmessage.TypeA); n != 2 {
+		t.Fatalf("queries after negative ttl = %d, want 2", n)
+	}
+}
+
+func TestResolverPrefer(t *testing.T) {
+	f := newFakeDNS(60)
+	server := f.serveUDP(t)
+	hosts := map[string][]string{"only6.lan": {"2001:db8::10"}}
+	ctx := context.Background()
+
+	tests := []struct {
+		prefer string
+		host   string
+		want   []string
+	}{
+		{"", "dual.test", []string{"192.0.2.1", "2001:db8::1"}},
+		{PreferIPv4, "dual.test", []string{"192.0.2.1", "2001:db8::1"}},
+		{PreferIPv6, "dual.test", []string{"2001:db8::1", "192.0.2.1"}},
+		{OnlyIPv4, "dual.test", []string{"192.0.2.1"}},
+		{OnlyIPv6, "dual.test", []string{"2001:db8::1"}},
+		{OnlyIPv4, "v6.test", nil},
+		{OnlyIPv6, "only6.lan", []string{"2001:db8::10"}},
+		{OnlyIPv4, "only6.lan", nil},
+	}
+
+	for _, tt := range tests {
+		r := newTestResolver(t, server, tt.prefer, hosts, nil)
+		ips, err := r.LookupIP(ctx, tt.host)
+		if tt.want == nil {
+			if !isNotFound(err) || len(ips) != 0 {
+				t.Errorf("prefer %q LookupIP(%s) = %v, %v, want not found", tt.prefer, tt.host, ips, err)
+			}
+			continue
+		}
+		if err != nil || !equalIPs(ips, tt.want...) {
+			t.Errorf("prefer %q LookupIP(%s) = %v, %v, want %v", tt.prefer, tt.host, ips, err, tt.want)
+		}
+	}
+
+	// ipv4-only 不查询AAAA记录.
+	if n := f.count("v6.test", dnsmessage.TypeAAAA); n != 0 {
+		t.Errorf("AAAA queries with ipv4-only = %d, want 0", n)
+	}
+}
@@ -0,0 +1,360 @@
+package wsproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ActionDirect 直接连接目标.
+	ActionDirect = "direct"
+
+	// ActionUpstream 通过上游wss服务器组转发.
+	ActionUpstream = "upstream"
+
+	// ActionProxy 通过上游socks5/http代理转发.
+	ActionProxy = "proxy"
+
+	// ActionReject 拒绝连接.
+	ActionReject = "reject"
+)
+
+// RuleConfig 路由规则配置, 所有非空条件均满足时命中, 同一条件内多个值任意一个满足即可.
+type RuleConfig struct {
+	Domain        []string `json:"Domain"`
+	DomainSuffix  []string `json:"DomainSuffix"`
+	DomainKeyword []string `json:"DomainKeyword"`
+	DomainFile    []string `json:"DomainFile"`
+	IPCIDR        []string `json:"IPCIDR"`
+	CIDRFile      []string `json:"CIDRFile"`
+	Port          []string `json:"Port"`
+	User          []string `json:"User"`
+	Action        string   `json:"Action"`
+	Upstream      string   `json:"Upstream"`
+
+	// 直连时使用的出口网卡和源地址, 为空时使用全局Direct配置.
+	Interface   string   `json:"Interface"`
+	BindAddress []string `json:"BindAddress"`
+}
+
+// Metadata 描述一次代理请求, 用于路由规则匹配和出站连接.
+type Metadata struct {
+	ID     uint64
+	Source net.Addr
+	Local  net.Addr
+	User   string
+	Host   string
+	Port   uint16
+
+	ips      []net.IP
+	resolved bool
+}
+
+// Address 返回 host:port 形式的目标地址.
+func (m *Metadata) Address() string {
+	return net.JoinHostPort(m.Host, strconv.Itoa(int(m.Port)))
+}
+
+// lookupIP 返回目标的ip地址, 域名只在需要匹配ip规则时解析一次.
+func (m *Metadata) lookupIP() []net.IP {
+	if m.resolved {
+		return m.ips
+	}
+	m.resolved = true
+
+	if ip := net.ParseIP(m.Host); ip != nil {
+		m.ips = []net.IP{ip}
+		return m.ips
+	}
+
+	ips, err := DefaultResolver.LookupIP(context.Background(), m.Host)
+	if err != nil {
+		fmt.Println(m.ID, "Rule lookup", m.Host, "error", err.Error())
+		return nil
+	}
+	m.ips = ips
+
+	return m.ips
+}
+
+type portRange struct {
+	begin uint16
+	end   uint16
+}
+
+// Rule 编译后的路由规则.
+type Rule struct {
+	Action   string
+	Upstream string
+	Direct   DirectConfig
+
+	domains  map[string]struct{}
+	suffixes []string
+	keywords []string
+	cidrs    []*net.IPNet
+	ports    []portRange
+	users    map[string]struct{}
+}
+
+// Router 按顺序匹配路由规则.
+type Router struct {
+	rules []*Rule
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip address %q", s)
+		}
+		if ip.To4() != nil {
+			s = s + "/32"
+		} else {
+			s = s + "/128"
+		}
+	}
+
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
+}
+
+func parsePortRange(s string) (portRange, error) {
+	var r portRange
+
+	parts := strings.SplitN(strings.TrimSpace(s), "-", 2)
+	begin, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return r, fmt.Errorf("invalid port %q", s)
+	}
+	end := begin
+	if len(parts) == 2 {
+		end, err = strconv.ParseUint(parts[1], 10, 16)
+		if err != nil || end < begin {
+			return r, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+
+	r.begin = uint16(begin)
+	r.end = uint16(end)
+
+	return r, nil
+}
+
+// readRuleFile 按行读取规则文件, 忽略空行和以'#'开头的注释.
+func readRuleFile(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, scanner.Err()
+}
+
+func (r *Rule) addDomain(line string) {
+	// 域名文件支持 full:/keyword:/domain: 前缀, 无前缀按后缀匹配.
+	switch {
+	case strings.HasPrefix(line, "full:"):
+		r.domains[normalizeDomain(line[len("full:"):])] = struct{}{}
+	case strings.HasPrefix(line, "keyword:"):
+		r.keywords = append(r.keywords, normalizeDomain(line[len("keyword:"):]))
+	case strings.HasPrefix(line, "domain:"):
+		r.suffixes = append(r.suffixes, normalizeDomain(line[len("domain:"):]))
+	default:
+		r.suffixes = append(r.suffixes, normalizeDomain(line))
+	}
+}
+
+// NewRule 编译一条路由规则, 加载其中引用的域名和CIDR文件.
+func NewRule(config RuleConfig) (*Rule, error) {
+	r := &Rule{
+		Action:   strings.ToLower(config.Action),
+		Upstream: config.Upstream,
+		Direct: DirectConfig{
+			Interface:   config.Interface,
+			BindAddress: config.BindAddress,
+		},
+		domains: make(map[string]struct{}),
+		users:   make(map[string]struct{}),
+	}
+
+	switch r.Action {
+	case ActionDirect, ActionUpstream, ActionReject:
+	case ActionProxy:
+		if r.Upstream == "" {
+			return nil, fmt.Errorf("proxy rule without upstream")
+		}
+	default:
+		return nil, fmt.Errorf("unknown rule action %q", config.Action)
+	}
+
+	for _, v := range config.Domain {
+		r.domains[normalizeDomain(v)] = struct{}{}
+	}
+	for _, v := range config.DomainSuffix {
+		r.suffixes = append(r.suffixes, normalizeDomain(v))
+	}
+	for _, v := range config.DomainKeyword {
+		r.keywords = append(r.keywords, normalizeDomain(v))
+	}
+	for _, name := range config.DomainFile {
+		lines, err := readRuleFile(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			r.addDomain(line)
+		}
+	}
+
+	cidrs := config.IPCIDR
+	for _, name := range config.CIDRFile {
+		lines, err := readRuleFile(name)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, lines...)
+	}
+	for _, v := range cidrs {
+		ipnet, err := parseCIDR(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		r.cidrs = append(r.cidrs, ipnet)
+	}
+
+	for _, v := range config.Port {
+		pr, err := parsePortRange(v)
+		if err != nil {
+			return nil, err
+		}
+		r.ports = append(r.ports, pr)
+	}
+
+	for _, v := range config.User {
+		r.users[v] = struct{}{}
+	}
+
+	return r, nil
+}
+
+func (r *Rule) hasDomainCond() bool {
+	return len(r.domains) > 0 || len(r.suffixes) > 0 || len(r.keywords) > 0
+}
+
+func (r *Rule) matchDomain(host string) bool {
+	if _, found := r.domains[host]; found {
+		return true
+	}
+	for _, suffix := range r.suffixes {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	for _, keyword := range r.keywords {
+		if strings.Contains(host, keyword) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Rule) matchIP(ips []net.IP) bool {
+	for _, ip := range ips {
+		for _, ipnet := range r.cidrs {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (r *Rule) matchPort(port uint16) bool {
+	for _, pr := range r.ports {
+		if port >= pr.begin && port <= pr.end {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Match 判断请求是否命中该规则.
+func (r *Rule) Match(m *Metadata) bool {
+	if len(r.users) > 0 {
+		if _, found := r.users[m.User]; !found {
+			return false
+		}
+	}
+
+	if len(r.ports) > 0 && !r.matchPort(m.Port) {
+		return false
+	}
+
+	if r.hasDomainCond() && !r.matchDomain(normalizeDomain(m.Host)) {
+		return false
+	}
+
+	if len(r.cidrs) > 0 && !r.matchIP(m.lookupIP()) {
+		return false
+	}
+
+	return true
+}
+
+// NewRouter 根据配置创建路由器.
+func NewRouter(configs []RuleConfig) (*Router, error) {
+	router := &Router{}
+
+	for i, config := range configs {
+		rule, err := NewRule(config)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		router.rules = append(router.rules, rule)
+	}
+
+	return router, nil
+}
+
+// Empty 是否没有配置任何规则.
+func (r *Router) Empty() bool {
+	return r == nil || len(r.rules) == 0
+}
+
+// Match 返回第一条命中的规则, 没有命中返回nil.
+func (r *Router) Match(m *Metadata) *Rule {
+	if r == nil {
+		return nil
+	}
+
+	for _, rule := range r.rules {
+		if rule.Match(m) {
+			return rule
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package wsproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	protoUnknown     = "unknown"
+	protoSocks4      = "socks4"
+	protoSocks5      = "socks5"
+	protoHTTP        = "http"
+	protoWebsocket   = "websocket"
+	protoTLS         = "tls"
+	protoPassthrough = "passthrough"
+	protoProxyV1     = "proxy-v1"
+	protoProxyV2     = "proxy-v2"
+
+	// sniffBufferSize 需要容纳一个完整的tls ClientHello记录.
+	sniffBufferSize = 32 * 1024
+
+	tlsRecordHandshake    = 0x16
+	tlsHandshakeHello     = 0x01
+	tlsExtServerName      = 0
+	tlsExtALPN            = 16
+	tlsMaxRecordLength    = 16384 + 2048
+	tlsRecordHeaderLength = 5
+)
+
+var (
+	// httpMethods 可以作为代理请求的http方法.
+	httpMethods = []string{
+		"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH",
+	}
+
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errInvalidClientHello = errors.New("invalid tls client hello")
+)
+
+// clientHello tls ClientHello中用于分流的字段.
+type clientHello struct {
+	serverName string
+	alpn       []string
+}
+
+// sniff 预读连接开头的数据判断协议类型, 不消耗reader中的数据.
+func sniff(reader *bufio.Reader) (string, *clientHello, error) {
+	peek, err := reader.Peek(1)
+	if err != nil {
+		return protoUnknown, nil, err
+	}
+
+	switch peek[0] {
+	case 0x05:
+		return protoSocks5, nil, nil
+	case 0x04:
+		return protoSocks4, nil, nil
+	case tlsRecordHandshake:
+		// ClientHello解析失败时仍按tls处理, 只是不能按SNI/ALPN分流.
+		hello, _ := sniffClientHello(reader)
+		return protoTLS, hello, nil
+	case proxyV2Signature[0]:
+		if peekPrefix(reader, proxyV2Signature) {
+			return protoProxyV2, nil, nil
+		}
+		return protoUnknown, nil, nil
+	}
+
+	if peekPrefix(reader, proxyV1Signature) {
+		return protoProxyV1, nil, nil
+	}
+
+	for _, method := range httpMethods {
+		if method[0] != peek[0] || !peekPrefix(reader, []byte(method+" ")) {
+			continue
+		}
+
+		// 请求目标为 /path 形式的GET请求不是代理请求, 可能是websocket握手.
+		if method == "GET" {
+			if target, err := reader.Peek(len(method) + 2); err == nil && target[len(method)+1] == '/' {
+				return protoWebsocket, nil, nil
+			}
+		}
+
+		return protoHTTP, nil, nil
+	}
+
+	return protoUnknown, nil, nil
+}
+
+// peekPrefix 判断reader是否以prefix开头, 首字节不匹配时不会阻塞等待更多数据.
+func peekPrefix(reader *bufio.Reader, prefix []byte) bool {
+	peek, err := reader.Peek(1)
+	if err != nil || peek[0] != prefix[0] {
+		return false
+	}
+
+	peek, err = reader.Peek(len(prefix))
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(peek, prefix)
+}
+
+// sniffClientHello 预读第一个tls记录并解析其中的ClientHello.
+func sniffClientHello(reader *bufio.Reader) (*clientHello, error) {
+	header, err := reader.Peek(tlsRecordHeaderLength)
+	if err != nil {
+		return nil, err
+	}
+
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if length > tlsMaxRecordLength || tlsRecordHeaderLength+length > reader.Size() {
+		return nil, errInvalidClientHello
+	}
+
+	record, err := reader.Peek(tlsRecordHeaderLength + length)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseClientHello(record[tlsRecordHeaderLength:])
+}
+
+// tlsReader 按tls编码规则读取定长字段和带长度前缀的向量.
+type tlsReader struct {
+	data []byte
+	err  bool
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if r.err || len(r.data) < n {
+		r.err = true
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *tlsReader) uint(n int) int {
+	v := 0
+	for _, b := range r.bytes(n) {
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+func (r *tlsReader) vector(lengthSize int) *tlsReader {
+	return &tlsReader{data: r.bytes(r.uint(lengthSize)), err: r.err}
+}
+
+// parseClientHello 从握手消息中解析SNI和ALPN扩展.
+func parseClientHello(data []byte) (*clientHello, error) {
+	r := &tlsReader{data: data}
+
+	if r.uint(1) != tlsHandshakeHello {
+		return nil, errInvalidClientHello
+	}
+	body := r.vector(3)
+	body.bytes(2)  // legacy_version
+	body.bytes(32) // random
+	body.vector(1) // legacy_session_id
+	body.vector(2) // cipher_suites
+	body.vector(1) // legacy_compression_methods
+	if body.err {
+		return nil, errInvalidClientHello
+	}
+
+	hello := &clientHello{}
+	if len(body.data) == 0 {
+		return hello, nil
+	}
+
+	extensions := body.vector(2)
+	for len(extensions.data) > 0 && !extensions.err {
+		typ := extensions.uint(2)
+		ext := extensions.vector(2)
+
+		switch typ {
+		case tlsExtServerName:
+			names := ext.vector(2)
+			for len(names.data) > 0 && !names.err {
+				nameType := names.uint(1)
+				name := names.vector(2)
+				if nameType == 0 && !name.err {
+					hello.serverName = string(name.data)
+				}
+			}
+		case tlsExtALPN:
+			protos := ext.vector(2)
+			for len(protos.data) > 0 && !protos.err {
+				proto := protos.vector(1)
+				if !proto.err {
+					hello.alpn = append(hello.alpn, string(proto.data))
+				}
+			}
+		}
+	}
+
+	if extensions.err {
+		return nil, errInvalidClientHello
+	}
+
+	return hello, nil
+}
@@ -2,9 +2,12 @@ package wsproxy
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"syscall"
 )
 
 const (
@@ -22,6 +25,16 @@ const (
 	socks5AtypIpv4       = uint8(0x01)
 	socks5AtypDomainName = uint8(0x03)
 	socks5AtypIpv6       = uint8(0x04)
+
+	socks5RepSucceeded            = uint8(0x00)
+	socks5RepGeneralFailure       = uint8(0x01)
+	socks5RepNotAllowed           = uint8(0x02)
+	socks5RepNetworkUnreachable   = uint8(0x03)
+	socks5RepHostUnreachable      = uint8(0x04)
+	socks5RepConnectionRefused    = uint8(0x05)
+	socks5RepTTLExpired           = uint8(0x06)
+	socks5RepCommandNotSupported  = uint8(0x07)
+	socks5RepAddrTypeNotSupported = uint8(0x08)
 )
 
 type closeWriter interface {
@@ -59,36 +72,82 @@ func proxy(dst bufio.Writer, src io.Reader, errCh chan error) {
 	errCh <- err
 }
 
-func isIPv6(str string) bool {
-	ip := net.ParseIP(str)
-	return ip.To4() == nil
+// socks5ReplyCode 把出站连接错误转换为 RFC 1928 应答码.
+func socks5ReplyCode(err error) uint8 {
+	var se socksError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+
+	switch {
+	case err == nil:
+		return socks5RepSucceeded
+	case errors.Is(err, ErrRejected):
+		return socks5RepNotAllowed
+	case errors.As(err, &se):
+		// 上游socks5服务器的应答码原样返回.
+		return uint8(se)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5RepConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5RepNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socks5RepHostUnreachable
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return socks5RepTTLExpired
+	}
+
+	return socks5RepGeneralFailure
 }
 
-func isIPv4(str string) bool {
-	ip := net.ParseIP(str)
-	return ip.To4() != nil
+// writeSocks5Reply 写入socks5应答, addr为nil或非ip地址时 BND.ADDR 为 0.0.0.0:0.
+func writeSocks5Reply(writer *bufio.Writer, rep uint8, addr net.Addr) {
+	//  |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+	writer.WriteByte(socks5Version)
+	writer.WriteByte(rep)
+	writer.WriteByte(0)
+
+	ip := net.IPv4zero
+	port := 0
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok && tcpAddr.IP != nil {
+		ip = tcpAddr.IP
+		port = tcpAddr.Port
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		writer.WriteByte(socks5AtypIpv4)
+		writer.Write(ip4)
+	} else {
+		writer.WriteByte(socks5AtypIpv6)
+		writer.Write(ip.To16())
+	}
+
+	writer.WriteByte(byte(port >> 8))
+	writer.WriteByte(byte(port))
+
+	writer.Flush()
 }
 
-func authMethod(ID uint64, handler AuthHandlerFunc, reader *bufio.Reader, writer *bufio.Writer) bool {
+func authMethod(ID uint64, handler AuthHandlerFunc, reader *bufio.Reader, writer *bufio.Writer) (string, bool) {
 	defer writer.Flush()
 
 	av, err := reader.ReadByte()
 	if err != nil || av != 1 {
 		fmt.Println(ID, "Socks5 auth version invalid")
-		return false
+		return "", false
 	}
 
 	uLen, err := reader.ReadByte()
 	if err != nil || uLen <= 0 || uLen > 255 {
 		fmt.Println(ID, "Socks5 auth user length invalid")
-		return false
+		return "", false
 	}
 
 	uBuf := make([]byte, uLen)
 	nr, err := reader.Read(uBuf)
 	if err != nil || nr != int(uLen) {
 		fmt.Println(ID, "Socks5 auth user error", nr)
-		return false
+		return "", false
 	}
 
 	user := string(uBuf)
@@ -96,14 +155,14 @@ func authMethod(ID uint64, handler AuthHandlerFunc, reader *bufio.Reader, writer
 	pLen, err := reader.ReadByte()
 	if err != nil || pLen <= 0 || pLen > 255 {
 		fmt.Println(ID, "Socks5 auth passwd length invalid", pLen)
-		return false
+		return "", false
 	}
 
 	pBuf := make([]byte, pLen)
 	nr, err = reader.Read(pBuf)
 	if err != nil || nr != int(pLen) {
 		fmt.Println(ID, "Socks5 auth passwd error", pLen, nr)
-		return false
+		return "", false
 	}
 
 	passwd := string(pBuf)
@@ -113,7 +172,7 @@ func authMethod(ID uint64, handler AuthHandlerFunc, reader *bufio.Reader, writer
 		if handler(user, passwd) {
 			writer.WriteByte(0x01)
 			writer.WriteByte(0x00)
-			return true
+			return user, true
 		}
 
 		// 认证失败.
@@ -124,12 +183,12 @@ func authMethod(ID uint64, handler AuthHandlerFunc, reader *bufio.Reader, writer
 		writer.WriteByte(0x00)
 	}
 
-	return false
+	return "", false
 }
 
 // StartSocks5Proxy ...
 func StartSocks5Proxy(ID uint64, tcpConn *bufio.ReadWriter, handler AuthHandlerFunc,
-	reader *bufio.Reader, writer *bufio.Writer) {
+	dial DialFunc, reader *bufio.Reader, writer *bufio.Writer) {
 
 	fmt.Println(ID, "* Start socks5 proxy...")
 
@@ -204,8 +263,11 @@ func StartSocks5Proxy(ID uint64, tcpConn *bufio.ReadWriter, handler AuthHandlerF
 	writer.Flush()
 
 	// Auth mode, read user passwd.
+	user := ""
 	if supportAuth {
-		if !authMethod(ID, handler, reader, writer) {
+		var ok bool
+		user, ok = authMethod(ID, handler, reader, writer)
+		if !ok {
 			fmt.Println(ID, "Socks5 auth not passed")
 			return
 		}
@@ -227,12 +289,6 @@ func StartSocks5Proxy(ID uint64, tcpConn *bufio.ReadWriter, handler AuthHandlerF
 		fmt.Println(ID, "Socks5 read command error", err.Error())
 		return
 	}
-	if command != socks5CmdConnect &&
-		command != socks5CmdBind &&
-		command != socks5CmdUDP {
-		fmt.Println(ID, "Socks5 read command invalid", command)
-		return
-	}
 
 	reader.ReadByte() // rsv byte
 	atyp, err := reader.ReadByte()
@@ -244,6 +300,7 @@ func StartSocks5Proxy(ID uint64, tcpConn *bufio.ReadWriter, handler AuthHandlerF
 		atyp != socks5AtypIpv4 &&
 		atyp != socks5AtypIpv6 {
 		fmt.Println(ID, "Socks5 read atyp invalid", atyp)
+		writeSocks5Reply(writer, socks5RepAddrTypeNotSupported, nil)
 		return
 	}
 
@@ -305,52 +362,33 @@ func StartSocks5Proxy(ID uint64, tcpConn *bufio.ReadWriter, handler AuthHandlerF
 	}
 
 	port := uint16(portNum1)<<8 + uint16(portNum2)
-	hostname = fmt.Sprintf("%s:%d", hostname, port)
-
-	//  |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
-	writer.WriteByte(socks5Version)
-
-	fmt.Println(ID, "Scoks5 connect to", hostname)
-
-	// Start connect to target host.
-	targetConn, err := net.Dial("tcp", hostname)
-	if err != nil {
-		writer.WriteByte(1) // SOCKS5_GENERAL_SOCKS_SERVER_FAILURE
-	} else {
-		writer.WriteByte(0) // SOCKS5_SUCCEEDED
+	m := &Metadata{
+		User: user,
+		Host: hostname,
+		Port: port,
 	}
+	hostname = m.Address()
 
-	// rsv byte
-	writer.WriteByte(0)
-
-	if err == nil {
-		hostport := targetConn.RemoteAddr().String()
-		host, _, _ := net.SplitHostPort(hostport)
-		if isIPv4(host) {
-			writer.WriteByte(socks5AtypIpv4)
-			writer.Write(net.ParseIP(host).To4())
-		} else if isIPv6(host) {
-			writer.WriteByte(socks5AtypIpv6)
-			writer.Write(net.ParseIP(host).To16())
-		} else {
-			writer.WriteByte(socks5AtypDomainName)
-			writer.WriteByte(byte(len(hostname)))
-			writer.WriteString(hostname)
-		}
-	} else {
-		writer.WriteByte(socks5AtypDomainName)
-		writer.WriteByte(byte(len(hostname)))
-		writer.WriteString(hostname)
+	// 目前只支持CONNECT命令.
+	if command != socks5CmdConnect {
+		fmt.Println(ID, "Socks5 command not supported", command)
+		writeSocks5Reply(writer, socks5RepCommandNotSupported, nil)
+		return
 	}
 
-	writer.WriteByte(portNum1)
-	writer.WriteByte(portNum2)
-
-	writer.Flush()
+	fmt.Println(ID, "Scoks5 connect to", hostname)
 
+	// Start connect to target host.
+	targetConn, err := dial(m)
 	if err != nil {
+		rep := socks5ReplyCode(err)
+		fmt.Println(ID, "Socks5 connect to", hostname, "error", err.Error(), "reply", rep)
+		writeSocks5Reply(writer, rep, nil)
 		return
 	}
+	defer targetConn.Close()
+
+	writeSocks5Reply(writer, socks5RepSucceeded, targetConn.LocalAddr())
 
 	// Start proxying
 	errCh := make(chan error, 2)
@@ -0,0 +1,213 @@
+package wsproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	socks4Version = uint8(4)
+
+	socks4CmdConnect = uint8(0x01)
+	socks4CmdBind    = uint8(0x02)
+
+	socks4RepGranted        = uint8(0x5A)
+	socks4RepRejected       = uint8(0x5B)
+	socks4RepIdentdFailed   = uint8(0x5C)
+	socks4RepIdentdMismatch = uint8(0x5D)
+
+	// socks4BindTimeout BIND命令等待目标主机连入的超时时间.
+	socks4BindTimeout = 2 * time.Minute
+)
+
+// writeSocks4Reply 写入socks4应答, addr为nil或非ipv4地址时 DSTIP 为 0.0.0.0.
+func writeSocks4Reply(writer *bufio.Writer, rep uint8, addr net.Addr) {
+	// | VN | CD | DSTPORT | DSTIP |
+	writer.WriteByte(0)
+	writer.WriteByte(rep)
+
+	ip := net.IPv4zero.To4()
+	port := 0
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+			ip = ip4
+		}
+		port = tcpAddr.Port
+	}
+
+	writer.WriteByte(byte(port >> 8))
+	writer.WriteByte(byte(port))
+	writer.Write(ip)
+
+	writer.Flush()
+}
+
+// readSocks4String 读取以'\0'结尾的字段, 长度受reader缓冲区大小限制.
+func readSocks4String(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadSlice(0)
+	if err != nil {
+		return "", err
+	}
+
+	return string(line[:len(line)-1]), nil
+}
+
+// socks4Auth 把USERID映射为用户, 需要认证时USERID可以是 user:passwd 或 Bearer 令牌.
+// 不需要认证时USERID未经验证, 不能作为用户名用于路由规则, 与socks5相同返回空用户.
+func socks4Auth(handler AuthHandlerFunc, userID string) (string, bool) {
+	if handler == nil {
+		return "", true
+	}
+
+	if i := strings.IndexByte(userID, ':'); i >= 0 {
+		if handler(userID[:i], userID[i+1:]) {
+			return userID[:i], true
+		}
+		return "", false
+	}
+
+	if user, found := tokenLookup(userID); found {
+		return user, true
+	}
+
+	return "", false
+}
+
+// StartSocks4Proxy 提供socks4及socks4a代理服务, 支持CONNECT和BIND命令.
+func StartSocks4Proxy(ID uint64, tcpConn *bufio.ReadWriter, handler AuthHandlerFunc,
+	dial DialFunc, bind BindFunc, reader *bufio.Reader, writer *bufio.Writer) {
+
+	fmt.Println(ID, "* Start socks4 proxy...")
+
+	// | VN | CD | DSTPORT | DSTIP | USERID | NULL |
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		fmt.Println(ID, "Socks4 read request error", err.Error())
+		return
+	}
+
+	if header[0] != socks4Version {
+		fmt.Println(ID, "Socks4 version invalid", header[0])
+		return
+	}
+
+	command := header[1]
+	port := uint16(header[2])<<8 + uint16(header[3])
+	ip := net.IP(header[4:8])
+
+	userID, err := readSocks4String(reader)
+	if err != nil {
+		fmt.Println(ID, "Socks4 read userid error", err.Error())
+		return
+	}
+
+	// socks4a: DSTIP为 0.0.0.x(x非0) 时, USERID之后跟随以'\0'结尾的域名.
+	hostname := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		hostname, err = readSocks4String(reader)
+		if err != nil || hostname == "" {
+			fmt.Println(ID, "Socks4a read domain error")
+			writeSocks4Reply(writer, socks4RepRejected, nil)
+			return
+		}
+	}
+
+	user, ok := socks4Auth(handler, userID)
+	if !ok {
+		fmt.Println(ID, "Socks4 auth not passed, userid", userID)
+		writeSocks4Reply(writer, socks4RepIdentdMismatch, nil)
+		return
+	}
+
+	m := &Metadata{
+		User: user,
+		Host: hostname,
+		Port: port,
+	}
+	hostname = m.Address()
+
+	var targetConn net.Conn
+	switch command {
+	case socks4CmdConnect:
+		fmt.Println(ID, "Socks4 connect to", hostname)
+
+		targetConn, err = dial(m)
+		if err != nil {
+			fmt.Println(ID, "Socks4 connect to", hostname, "error", err.Error())
+			writeSocks4Reply(writer, socks4RepRejected, nil)
+			return
+		}
+
+		writeSocks4Reply(writer, socks4RepGranted, targetConn.LocalAddr())
+	case socks4CmdBind:
+		fmt.Println(ID, "Socks4 bind for", hostname)
+
+		targetConn, err = socks4Bind(ID, bind, m, writer)
+		if err != nil {
+			fmt.Println(ID, "Socks4 bind for", hostname, "error", err.Error())
+			writeSocks4Reply(writer, socks4RepRejected, nil)
+			return
+		}
+
+		writeSocks4Reply(writer, socks4RepGranted, targetConn.RemoteAddr())
+	default:
+		fmt.Println(ID, "Socks4 command not supported", command)
+		writeSocks4Reply(writer, socks4RepRejected, nil)
+		return
+	}
+	defer targetConn.Close()
+
+	// Start proxying
+	errCh := make(chan error, 2)
+	tw := bufio.NewWriter(targetConn)
+	go proxy(*tw, tcpConn.Reader, errCh)
+	go proxy(*tcpConn.Writer, targetConn, errCh)
+
+	// Wait
+	for i := 0; i < 2; i++ {
+		e := <-errCh
+		if e != nil {
+			break
+		}
+	}
+}
+
+// socks4Bind 监听端口并回复第一个应答, 等待目标主机连入, 来源不是DSTIP时失败.
+func socks4Bind(ID uint64, bind BindFunc,
+	m *Metadata, writer *bufio.Writer) (net.Conn, error) {
+
+	listener, err := bind(m)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+
+	// 监听在所有地址上时应答中的 DSTIP 为 0.0.0.0, 客户端应使用socks服务器的地址.
+	bindAddr := listener.Addr()
+	writeSocks4Reply(writer, socks4RepGranted, bindAddr)
+
+	fmt.Println(ID, "Socks4 bind listen on", bindAddr)
+
+	if tcpListener, ok := listener.(*net.TCPListener); ok {
+		tcpListener.SetDeadline(time.Now().Add(socks4BindTimeout))
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// 目标是域名时不做来源地址检查.
+	expected := net.ParseIP(m.Host)
+	remote, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if expected != nil && !expected.IsUnspecified() && (remote == nil || !remote.IP.Equal(expected)) {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected connection from %v", conn.RemoteAddr())
+	}
+
+	return conn, nil
+}
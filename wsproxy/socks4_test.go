@@ -0,0 +1,27 @@
+package wsproxy
+
+import "testing"
+
+func TestSocks4AuthUser(t *testing.T) {
+	allow := func(user, passwd string) bool { return user == "alice" && passwd == "pw" }
+
+	tests := []struct {
+		handler AuthHandlerFunc
+		userID  string
+		user    string
+		ok      bool
+	}{
+		// 没有认证时不信任客户端声称的身份.
+		{nil, "admin", "", true},
+		{allow, "alice:pw", "alice", true},
+		{allow, "alice:wrong", "", false},
+		{allow, "admin", "", false},
+	}
+
+	for _, tt := range tests {
+		user, ok := socks4Auth(tt.handler, tt.userID)
+		if user != tt.user || ok != tt.ok {
+			t.Errorf("socks4Auth(%q) = %q, %v, want %q, %v", tt.userID, user, ok, tt.user, tt.ok)
+		}
+	}
+}
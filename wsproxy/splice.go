@@ -2,18 +2,17 @@ package wsproxy
 
 import (
 	"bufio"
-	"bytes"
-	"compress/zlib"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"net/url"
+	"strings"
 
 	"gitee.com/jackarain/wsproxy/websocket"
+	"github.com/gobwas/httphead"
 	"github.com/gobwas/ws"
 )
 
@@ -31,61 +30,105 @@ func parseAuthority(location *url.URL) string {
 	return location.Host
 }
 
-func readFull(r io.Reader) (buf []byte, err error) {
-	buf = make([]byte, 256*1024)
-	n := 0
-	for err == nil {
-		var nn int
-		nn, err = r.Read(buf[n:])
-		n += nn
-		if err == nil && n == len(buf) {
-			blen := 2 * n
-			tmp := make([]byte, blen)
-			copy(tmp, buf)
-			buf = tmp
-		}
+const (
+	// encodingZlib 旧版本的压缩方式, 通过 Content-Encoding 头请求, 服务端不确认.
+	encodingZlib = "zlib"
+
+	// encodingNone 不压缩.
+	encodingNone = "none"
+)
+
+// parseCompression 取出url中 compression 参数指定的压缩方式并从url中删除, 没有指定时使用 Encoding.
+func parseCompression(u *url.URL) ([]string, error) {
+	query := u.Query()
+	if _, ok := query["compression"]; !ok {
+		return parseEncoding(Encoding)
 	}
-	buf = buf[:n]
-	return
+
+	value := query.Get("compression")
+	query.Del("compression")
+	u.RawQuery = query.Encode()
+
+	return parseEncoding(value)
 }
 
-// StartConnectServer ...
-func StartConnectServer(ID uint64, tcpConn *net.TCPConn,
-	reader *bufio.Reader, writer *bufio.Writer, server string) (insize, tosize int) {
-	defer tcpConn.Close()
+// parseEncoding 解析压缩方式列表, 多个压缩方式以逗号分隔, 按优先顺序在握手时请求,
+// zlib 不能与其它压缩方式同时使用, none 表示不压缩.
+func parseEncoding(value string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || name == encodingNone {
+			continue
+		}
+		names = append(names, name)
+	}
 
-	insize = 0
-	tosize = 0
+	for _, name := range names {
+		if name == encodingZlib {
+			if len(names) > 1 {
+				return nil, fmt.Errorf("compression %q can not be combined with others", encodingZlib)
+			}
+			return names, nil
+		}
+	}
+	if _, err := websocket.CompressionOffer(names); err != nil {
+		return nil, err
+	}
 
-	fmt.Println(ID, "* Start proxy with client:", tcpConn.RemoteAddr())
+	return names, nil
+}
+
+// upstreamTLSConfig 返回local server及wss出站连接上游使用的tls配置, 只在 VerifyClientCert 时校验服务器证书.
+func upstreamTLSConfig(ID uint64) *tls.Config {
+	certs := certSources()
 
 	// 打开ca文件.
-	pool := x509.NewCertPool()
-	ca, err := ioutil.ReadFile(caCerts)
-	if err == nil {
-		pool.AppendCertsFromPEM(ca)
-	} else if ServerVerifyClientCert {
-		fmt.Println(ID, "Open ca file error", err.Error())
+	pool, err := loadCertPool(certs.CA)
+	if err != nil {
+		pool = x509.NewCertPool()
+		if ServerVerifyClientCert {
+			fmt.Println(ID, "Open ca file error", err.Error())
+		}
 	}
 
 	// 加载客户端证书文件及key.
-	clientCert, err := tls.LoadX509KeyPair(ClientCert, ClientKey)
+	clientCert, err := loadKeyPair(certs.ClientCert, certs.ClientKey)
 	if err != nil && ServerVerifyClientCert {
-		fmt.Println(ID, "Open client cert file error", err.Error())
+		fmt.Println(ID, "Open client cert file error", describeCert(certs.ClientCert), err.Error())
 	}
 
 	// 设置tls相关参数.
-	tlsConfig := &tls.Config{
+	return &tls.Config{
 		RootCAs:            pool,
 		Certificates:       []tls.Certificate{clientCert},
 		InsecureSkipVerify: !ServerVerifyClientCert,
 	}
+}
+
+// dialWebsocket 连接上游wss服务器并完成websocket握手, 返回websocket字节流.
+// tlsConfig 为nil时使用 upstreamTLSConfig, netDial 为nil时直接连接服务器.
+func dialWebsocket(ID uint64, server string, tlsConfig *tls.Config,
+	netDial func(ctx context.Context, network, addr string) (net.Conn, error)) (*websocket.Conn, error) {
+	if tlsConfig == nil {
+		tlsConfig = upstreamTLSConfig(ID)
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
 
 	// 解析url.
 	url, err := url.Parse(server)
 	if err != nil {
-		fmt.Println(ID, "Parse url error", err.Error())
-		return
+		return nil, err
+	}
+
+	// 用户名密码只用于上游socks5认证, 不发送给websocket服务器.
+	url.User = nil
+
+	// 压缩方式只用于握手, 不发送给websocket服务器.
+	compression, err := parseCompression(url)
+	if err != nil {
+		return nil, err
 	}
 
 	// 如果配置ServerName为空, 则添加一个默认hostname.
@@ -94,143 +137,104 @@ func StartConnectServer(ID uint64, tcpConn *net.TCPConn,
 	}
 
 	// 发起网络连接到url.
-	fmt.Println(ID, "Connecting to:", url.Hostname(), "from", tcpConn.RemoteAddr())
+	fmt.Println(ID, "Connecting to:", url.Hostname())
 
+	// 按优先顺序请求压缩方式, 由服务端选择, zlib 为旧版本的压缩方式.
+	encoding := ""
 	var header ws.HandshakeHeader
-	if Encoding == "zlib" {
+	var extensions []httphead.Option
+	if len(compression) == 1 && compression[0] == encodingZlib {
+		encoding = encodingZlib
 		header = ws.HandshakeHeaderString("Content-Encoding: zlib\r\n")
+	} else if extensions, err = websocket.CompressionOffer(compression); err != nil {
+		return nil, err
 	}
 	d := ws.Dialer{
-		TLSConfig: tlsConfig,
-		Header:    header,
+		TLSConfig:  tlsConfig,
+		Header:     header,
+		Extensions: extensions,
+		NetDial:    netDial,
 	}
 
-	c, _, _, err := d.Dial(context.Background(), server)
+	c, br, hs, err := d.Dial(context.Background(), url.String())
 	if err != nil {
-		fmt.Println(ID, "Dialer error", err.Error())
-		return
+		return nil, err
 	}
 
-	defer c.Close()
+	// 服务端不支持请求的任何压缩方式时不压缩.
+	name, deflate, err := websocket.ParseCompressionResponse(hs.Extensions)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
 
-	rw := c.(io.ReadWriter)
-	conn := &websocket.Websocket{
-		Conn: &rw,
+	// 握手时多读取的数据需要继续从br中读取.
+	if br != nil {
+		bc := newBufferedConn(c)
+		bc.rw.Reader = br
+		c = bc
 	}
 
-	fmt.Println(ID, "Established with:", url.Hostname(), "from", tcpConn.RemoteAddr())
+	if len(compression) > 0 && encoding == "" {
+		if name == "" {
+			name = encodingNone
+		}
+		fmt.Println(ID, "Websocket compression:", name)
+	}
 
-	// 开始使用ws对象收发websocket数据.
-	errCh := make(chan error, 2)
-	// origin -> ws
-	go func(dst *websocket.Websocket, src *bufio.Reader) {
-		buf := make([]byte, 256*1024)
-		var err error
-		var sbuf []byte
-
-		for {
-			nr, er := src.Read(buf)
-			sbuf = buf
-
-			if nr > 0 {
-				if Encoding == "zlib" {
-					var gbuf bytes.Buffer
-					w := zlib.NewWriter(&gbuf)
-					nz, ez := w.Write(buf[0:nr])
-					if nz != nr {
-						err = io.ErrShortWrite
-						break
-					}
-					if ez != nil {
-						err = ez
-						break
-					}
-					w.Close()
-
-					sbuf = gbuf.Bytes()
-					nr = len(sbuf)
-					tosize = tosize + (nz - nr)
-				} else {
-					tosize = tosize + nr
-				}
-
-				ew := dst.WriteMessage(ws.OpBinary, sbuf[0:nr])
-				if ew != nil {
-					err = ew
-					break
-				}
-			}
+	return newClientConn(c, encoding, name, deflate), nil
+}
 
-			if er != nil {
-				err = er
-				break
-			}
-		}
+// StartConnectServer ...
+func StartConnectServer(ID uint64, tcpConn net.Conn,
+	reader *bufio.Reader, writer *bufio.Writer, server string) (insize, tosize int) {
+	defer tcpConn.Close()
 
-		errCh <- err
-	}(conn, reader)
-
-	// ws -> origin
-	go func(dst *bufio.Writer, src *websocket.Websocket) {
-		var err error
-		var sbuf []byte
-
-		for {
-			_, buf, er := src.ReadMessage()
-			nr := len(buf)
-			if nr > 0 {
-				if Encoding == "zlib" {
-					b := bytes.NewReader(buf[0:nr])
-					r, ez := zlib.NewReader(b)
-					if ez != nil {
-						err = ez
-						break
-					}
-					sbuf, ez = readFull(r)
-					nn := len(sbuf)
-					if ez != nil && ez != io.EOF {
-						er = ez
-						if nn <= 0 {
-							err = ez
-							break
-						}
-					}
-					insize = insize + (nn - nr)
-					nr = nn
-					r.Close()
-				} else {
-					sbuf = buf
-					insize = insize + nr
-				}
-
-				nw, ew := dst.Write(sbuf[0:nr])
-				if nw != nr {
-					err = io.ErrShortWrite
-					break
-				}
-				dst.Flush()
-
-				if ew != nil {
-					err = ew
-					break
-				}
-			}
+	insize = 0
+	tosize = 0
 
-			if er != nil {
-				err = er
-				break
-			}
-		}
+	fmt.Println(ID, "* Start proxy with client:", tcpConn.RemoteAddr())
 
-		dst.Flush()
-		errCh <- err
-	}(writer, conn)
+	conn, err := dialWebsocket(ID, server, nil, nil)
+	if err != nil {
+		fmt.Println(ID, "Dialer error", err.Error())
+		return
+	}
+
+	defer conn.Close()
+	defer logTunnel(ID, conn)
+
+	fmt.Println(ID, "Established with:", server, "from", tcpConn.RemoteAddr())
 
-	// 等待转发退出.
+	// 开始使用ws字节流转发数据.
+	type result struct {
+		n   int64
+		dir int
+	}
+	ch := make(chan result, 2)
+	// origin -> ws
+	go func() {
+		n, _ := io.Copy(conn, reader)
+		ch <- result{n, 0}
+	}()
+	// ws -> origin, reader中可能还有预读的数据, 写入时直接写tcpConn.
+	go func() {
+		writer.Flush()
+		n, _ := io.Copy(tcpConn, conn)
+		ch <- result{n, 1}
+	}()
+
+	// 任意一个方向结束即关闭两端, 等待另一个方向退出.
 	for i := 0; i < 2; i++ {
-		e := <-errCh
-		if e != nil {
-			break
+		r := <-ch
+		if r.dir == 0 {
+			tosize = int(r.n)
+		} else {
+			insize = int(r.n)
+		}
+		if i == 0 {
+			conn.Close()
+			tcpConn.Close()
 		}
 	}
 
@@ -2,40 +2,30 @@ package wsproxy
 
 import (
 	"bufio"
-	"bytes"
-	"compress/zlib"
+	"compress/flate"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
-	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync/atomic"
+	"time"
 
 	"gitee.com/jackarain/wsproxy/websocket"
-	"github.com/gobwas/ws"
 )
 
 var (
-	// caCerts ...
-	caCerts = ".wsproxy/certs/ca.crt"
-
-	// ServerCert ...
-	ServerCert = ".wsproxy/certs/server.crt"
-
-	// ServerKey ...
-	ServerKey = ".wsproxy/certs/server.key"
-
-	// ClientCert ...
-	ClientCert = ".wsproxy/certs/client.crt"
-
-	// ClientKey ...
-	ClientKey = ".wsproxy/certs/client.key"
+	// CACert、ServerCert、ServerKey、ClientCert、ClientKey、CRL 为证书、私钥及吊销列表的文件路径或PEM内容,
+	// 一般由命令行参数设置, 为空时依次使用 WSPROXY_CA_CERT 等环境变量、配置文件中的 Certs 及 .wsproxy/certs 下的默认路径.
+	CACert     string
+	ServerCert string
+	ServerKey  string
+	ClientCert string
+	ClientKey  string
+	CRL        string
 
 	// UnixSockAddr ...
 	UnixSockAddr = "wsproxy.sock"
@@ -43,7 +33,8 @@ var (
 	// JSONConfig ...
 	JSONConfig = "config.json"
 
-	// ServerVerifyClientCert ...
+	// ServerVerifyClientCert 对应配置中的 VerifyClientCert, 为true时local server及wss出站校验上游服务器的证书,
+	// 名称沿用旧版本, 要求客户端证书使用 Certs.RequireClientCert.
 	ServerVerifyClientCert = false
 
 	// ServerTLSConfig ...
@@ -57,22 +48,69 @@ var (
 
 	// Encoding ...
 	Encoding string
+
+	// MaxFrameSize 及 MaxMessageSize 为websocket接收的帧及消息的最大长度, 为0时使用默认值.
+	MaxFrameSize   int64
+	MaxMessageSize int64
+
+	// PingInterval 及 PongTimeout 为websocket隧道发送Ping的间隔及等待Pong的超时, PingInterval为0时不发送.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// CompressionLevel 隧道压缩级别, 为0时使用默认级别.
+	CompressionLevel int
+
+	// AlwaysCompress 为true时隧道压缩所有数据, 否则压缩没有效果时暂停压缩.
+	AlwaysCompress bool
+
+	// MaxInflationRatio 隧道压缩消息的最大解压比例, 为0时使用默认值.
+	MaxInflationRatio int
 )
 
 // UserInfo ...
 type UserInfo struct {
 	User   string
 	Passwd string
+	Token  string
 }
 
 // Configuration ...
 type Configuration struct {
-	Servers                []string   `json:"Servers"`
+	Servers []string `json:"Servers"`
+
+	// ServerVerifyClientCert 为true时校验上游服务器的证书, 不是要求客户端证书.
 	ServerVerifyClientCert bool       `json:"VerifyClientCert"`
 	Listen                 string     `json:"ListenAddr"`
 	Users                  []UserInfo `json:"Users"`
 	UpstreamProxyServer    string     `json:"UpstreamProxyServer"`
 	Encoding               string     `json:"Encoding"`
+
+	// http代理认证方式.
+	HTTPAuth HTTPAuthConfig `json:"HTTPAuth"`
+
+	// 路由规则、上游服务器分组及命名出站.
+	Rules          []RuleConfig              `json:"Rules"`
+	UpstreamGroups map[string][]string       `json:"UpstreamGroups"`
+	Outbounds      map[string]OutboundConfig `json:"Outbounds"`
+
+	// 域名解析及直连出站.
+	DNS    DNSConfig    `json:"DNS"`
+	Direct DirectConfig `json:"Direct"`
+
+	// 接收及发送PROXY协议头.
+	ProxyProtocol ProxyProtocolConfig `json:"ProxyProtocol"`
+
+	// websocket入站及长度限制.
+	Websocket WebsocketConfig `json:"Websocket"`
+
+	// 本机unix socket入站.
+	UnixSocket UnixSocketConfig `json:"UnixSocket"`
+
+	// 按SNI/ALPN透传的tls连接.
+	Passthrough []PassthroughConfig `json:"Passthrough"`
+
+	// 证书及私钥的位置.
+	Certs CertsConfig `json:"Certs"`
 }
 
 // AuthHandlerFunc ...
@@ -88,10 +126,43 @@ type Server struct {
 	config     Configuration
 	listen     *net.TCPListener
 	unixListen net.Listener
+	router     *Router
+
+	// 出站.
+	outbounds     map[string]Dialer
+	groups        map[string]Dialer
+	routes        map[*Rule]Dialer
+	defaultDialer Dialer
+
+	// 允许发送PROXY协议头的负载均衡地址及可信的反向代理地址.
+	trustedProxies    []*net.IPNet
+	trustedForwarders []*net.IPNet
 
 	authFunc AuthHandlerFunc
 }
 
+// UnixSocketConfig unix socket入站配置, 供本机进程使用socks5/socks4/http代理.
+type UnixSocketConfig struct {
+	// Path socket文件路径, 为空时不启动unix socket入站.
+	Path string `json:"Path"`
+
+	// Mode socket文件权限, 八进制字符串, 默认为 0600.
+	Mode string `json:"Mode"`
+}
+
+func (c UnixSocketConfig) fileMode() (os.FileMode, error) {
+	if c.Mode == "" {
+		return 0600, nil
+	}
+
+	mode, err := strconv.ParseUint(c.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid unix socket mode %q", c.Mode)
+	}
+
+	return os.FileMode(mode), nil
+}
+
 func makeUnixSockName() string {
 	return filepath.Join(os.TempDir(), UnixSockAddr)
 }
@@ -117,233 +188,161 @@ func (b bufferedConn) Read(p []byte) (int, error) {
 	return b.rw.Read(p)
 }
 
-func (s *Server) startWSS(ID uint64, bc bufferedConn) {
-	fmt.Println(ID, "* Start tls connection...")
-
-	// 转换成TLS connection对象.
-	TLSConn := tls.Server(bc, ServerTLSConfig)
+// startWSS 在已完成tls握手的连接上建立websocket隧道.
+func (s *Server) startWSS(in *inboundConn) {
+	ID := in.ID
+	bc := in.bc
 
-	// 开始握手.
-	err := TLSConn.Handshake()
+	// 创建websocket连接.
+	wsconn, err := websocket.NewWebsocket(bc)
 	if err != nil {
-		fmt.Println(ID, "tls connection handshake fail", err.Error())
+		fmt.Println(ID, "tls connection Upgrade to websocket", err.Error())
 		return
 	}
 
-	// 创建websocket连接.
-	wsconn, err := websocket.NewWebsocket(TLSConn)
+	// 经由可信反向代理连入时, 使用其转发的客户端地址.
+	if remote := s.forwardedFor(in.remote, wsconn.Header); remote != in.remote {
+		fmt.Println(ID, "Websocket from", in.remote, "forwarded for", remote)
+		in.remote = remote
+	}
+
+	s.relayWebsocket(in, wsconn)
+}
+
+// logTunnel 隧道结束时输出关闭的原因、Ping/Pong测得的往返时间及压缩效果.
+func logTunnel(ID uint64, conn *websocket.Conn) {
+	w := conn.Websocket()
+	if err := w.Failure(); err != nil {
+		fmt.Println(ID, "Websocket closed:", err.Code, err.Reason)
+	}
+
+	if conn.TimedOut() {
+		fmt.Println(ID, "Websocket pong timeout, rtt:", conn.RTT())
+	} else if PingInterval > 0 {
+		fmt.Println(ID, "Websocket rtt:", conn.RTT())
+	}
+
+	if w.Compression != "" || w.Encoding == encodingZlib {
+		written, sent := conn.WriteStats()
+		fmt.Println(ID, "Websocket compression:", written, "bytes sent as", sent)
+	}
+}
+
+// dialLegacyUpstream 连接UpstreamProxyServer, 用于原样转发websocket隧道中的数据.
+func (s *Server) dialLegacyUpstream(in *inboundConn) (net.Conn, error) {
+	c, err := net.Dial("tcp", s.config.UpstreamProxyServer)
 	if err != nil {
-		fmt.Println(ID, "tls connection Upgrade to websocket", err.Error())
-		return
+		return nil, err
+	}
+
+	// 原样转发到UpstreamProxyServer时, 通过PROXY协议头传递客户端地址.
+	if s.config.ProxyProtocol.Send != 0 {
+		_, err = c.Write(makeProxyHeader(s.config.ProxyProtocol.Send, in.remote, in.local))
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
 	}
 
-	network := "unix"
-	addr := makeUnixSockName()
+	return c, nil
+}
 
-	if s.config.UpstreamProxyServer != "" {
-		network = "tcp"
-		addr = s.config.UpstreamProxyServer
+// relayWebsocket 处理websocket隧道中的数据, 隧道中的socks5/http请求直接在进程内处理.
+func (s *Server) relayWebsocket(in *inboundConn, wsconn *websocket.Websocket) {
+	ID := in.ID
+	bc := in.bc
+
+	// 限制接收的帧及消息长度.
+	wsconn.MaxFrameSize = MaxFrameSize
+	wsconn.MaxMessageSize = MaxMessageSize
+	wsconn.CompressionLevel = CompressionLevel
+	wsconn.AlwaysCompress = AlwaysCompress
+	wsconn.MaxInflationRatio = MaxInflationRatio
+
+	// 定时发送Ping保持连接, 超时没有收到Pong时关闭隧道.
+	conn := websocket.NewConn(bc, wsconn)
+	conn.KeepAlive(PingInterval, PongTimeout)
+	defer conn.Close()
+	defer logTunnel(ID, conn)
+
+	if !isLegacyUpstream(&s.config) {
+		s.serveInbound(&inboundConn{
+			ID:       ID,
+			conn:     conn,
+			bc:       newBufferedConn(conn),
+			remote:   in.remote,
+			local:    in.local,
+			tunneled: true,
+		})
+		return
 	}
 
-	c, err := net.Dial(network, addr)
+	c, err := s.dialLegacyUpstream(in)
 	if err != nil {
 		fmt.Println(ID, "tls connect to target socket", err.Error())
 		return
 	}
 	defer c.Close()
 
+	// websocket字节流与上游连接之间双向转发, 任意一个方向结束即退出.
 	errCh := make(chan error, 2)
-	go func(c net.Conn, wsconn *websocket.Websocket) {
-		buf := make([]byte, 256*1024)
-		var err error
-		var sbuf []byte
-
-		for {
-			nr, er := c.Read(buf)
-			sbuf = buf
-			if nr > 0 {
-
-				if wsconn.Encoding == "zlib" {
-					var gbuf bytes.Buffer
-					w := zlib.NewWriter(&gbuf)
-					nz, ez := w.Write(buf[0:nr])
-					if nz != nr {
-						err = io.ErrShortWrite
-						break
-					}
-					if ez != nil {
-						err = ez
-						break
-					}
-					w.Close()
-
-					sbuf = gbuf.Bytes()
-					nr = len(sbuf)
-				}
-
-				ew := wsconn.WriteMessage(ws.OpBinary, sbuf[0:nr])
-				if ew != nil {
-					err = ew
-					break
-				}
-				bc.rw.Flush()
-			}
-
-			if er != nil {
-				err = er
-				break
-			}
-		}
-
-		errCh <- err
-	}(c, wsconn)
-
-	go func(wsconn *websocket.Websocket, c net.Conn) {
-		var err error
-		sbuf := make([]byte, 512*1024)
-
-		for {
-			_, msg, er := wsconn.ReadMessage()
-			nr := len(msg)
-			if len(msg) > 0 {
-
-				if wsconn.Encoding == "zlib" {
-					b := bytes.NewReader(msg)
-					r, ez := zlib.NewReader(b)
-					if ez != nil {
-						err = ez
-						break
-					}
-					nn, ez := r.Read(sbuf)
-					if ez != nil && ez != io.EOF {
-						err = ez
-						break
-					}
-					nr = nn
-					r.Close()
-				} else {
-					sbuf = msg
-				}
-
-				nw, ew := c.Write(sbuf[0:nr])
-				if nw != nr {
-					err = io.ErrShortWrite
-					break
-				}
-
-				if ew != nil {
-					err = ew
-					break
-				}
-			}
-
-			if er != nil {
-				err = er
-				break
-			}
-		}
-
-		errCh <- err
-	}(wsconn, c)
+	go proxy(*bufio.NewWriter(c), conn, errCh)
+	go proxy(*bufio.NewWriter(conn), c, errCh)
 
-	for i := 0; i < 2; i++ {
-		e := <-errCh
-		if e != nil {
-			break
-		}
-	}
+	<-errCh
 }
 
 func (s *Server) handleClientConn(conn *net.TCPConn) {
 	// 计算连接id.
 	ID := atomic.AddUint64(&ConnectionID, 1)
 
-	// 创建带buffer的Connection.
-	bc := newBufferedConn(conn)
+	// 创建带buffer的Connection, buffer需要能容纳tls ClientHello以便按SNI分流.
+	bc := newBufferedConnSize(conn, sniffBufferSize)
 	defer bc.Close()
 
-	reader := bc.rw.Reader
-	peek, err := reader.Peek(1)
-	if err != nil {
-		fmt.Println(ID, "Peek first byte error", err.Error())
-		return
-	}
-
-	writer := bc.rw.Writer
-
-	idx := -1
-	if len(s.config.Servers) > 0 {
-		idx = rand.Intn(len(s.config.Servers))
-	}
-
-	if peek[0] == 0x05 {
-		// 如果是socks5协议, 则调用socks5协议库, 若是client模式直接使用tls转发到服务器.
-		if idx >= 0 {
-			// 随机选择一个上游服务器用于转发socks5协议.
-			insize, tosize := StartConnectServer(ID, conn, reader, writer, s.config.Servers[idx])
-			fmt.Println(ID, "- Exit proxy with client:", conn.RemoteAddr(), insize, tosize)
-		} else {
-			// 没有配置上游服务器地址, 直接作为socks5服务器提供socks5服务.
-			StartSocks5Proxy(ID, bc.rw, s.authFunc, reader, writer)
-			fmt.Println(ID, "- Leave socks5 proxy with client:", conn.RemoteAddr())
-		}
-	} else if peek[0] == 0x47 || peek[0] == 0x43 {
-		// 如果'G' 或 'C', 则按http proxy处理, 若是client模式直接使用tls转发到服务器.
-		if idx >= 0 {
-			// 随机选择一个上游服务器用于转发http proxy协议.
-			insize, tosize := StartConnectServer(ID, conn, reader, writer, s.config.Servers[idx])
-			fmt.Println(ID, "- Exit proxy with client:", conn.RemoteAddr(), insize, tosize)
-		} else {
-			StartHTTPProxy(ID, bc.rw, s.authFunc, reader, writer)
-			fmt.Println(ID, "- Leave http proxy with client:", conn.RemoteAddr())
-		}
-	} else if peek[0] == 0x16 {
-		s.startWSS(ID, bc)
-		fmt.Println(ID, "- WSS Proxy disconnect...")
-	} else {
-		fmt.Println(ID, "- Unknown protocol!")
-	}
+	s.serveInbound(&inboundConn{
+		ID:     ID,
+		conn:   conn,
+		bc:     bc,
+		remote: conn.RemoteAddr(),
+		local:  conn.LocalAddr(),
+	})
 }
 
 func (s *Server) handleUnixConn(conn net.Conn) {
 	bc := newBufferedConn(conn)
 	defer bc.Close()
-	reader := bc.rw.Reader
-	peek, err := reader.Peek(1)
-	if err != nil {
-		return
-	}
-
-	writer := bc.rw.Writer
 
 	ID := atomic.AddUint64(&ConnectionID, 1)
 	fmt.Println(ID, "Start Unix connection...")
 
-	if peek[0] == 0x05 {
-		StartSocks5Proxy(ID, bc.rw, s.authFunc, reader, writer)
-	} else if peek[0] == 0x47 || peek[0] == 0x43 {
-		StartHTTPProxy(ID, bc.rw, s.authFunc, reader, writer)
-	} else {
-		fmt.Println(ID, "Unknown protocol!")
-		return
-	}
+	s.serveInbound(&inboundConn{
+		ID:       ID,
+		conn:     conn,
+		bc:       bc,
+		remote:   conn.RemoteAddr(),
+		local:    conn.LocalAddr(),
+		tunneled: true,
+	})
 
 	fmt.Println(ID, "Exit Unix connection!")
 }
 
 func initTLSServer() {
+	certs := certSources()
+
 	// Server ca cert pool.
-	CertPool := x509.NewCertPool()
-	ca, err := ioutil.ReadFile(caCerts)
-	if err == nil {
-		CertPool.AppendCertsFromPEM(ca)
-	} else if ServerVerifyClientCert {
-		fmt.Println("Open ca file error", err.Error())
+	CertPool, err := loadCertPool(certs.CA)
+	if err != nil {
+		CertPool = x509.NewCertPool()
+		if certsConfig.RequireClientCert {
+			fmt.Println("Open ca file error", err.Error())
+		}
 	}
 
-	serverCert, err := tls.LoadX509KeyPair(ServerCert, ServerKey)
+	serverCert, err := loadKeyPair(certs.ServerCert, certs.ServerKey)
 	if err != nil {
-		fmt.Println("Open server cert file error", err.Error())
+		fmt.Println("Open server cert file error", describeCert(certs.ServerCert), err.Error())
 	}
 
 	ServerTLSConfig = &tls.Config{
@@ -351,24 +350,36 @@ func initTLSServer() {
 		RootCAs:      CertPool,
 		Certificates: []tls.Certificate{serverCert},
 	}
-}
 
-// NewServer ...
-func NewServer(serverList []string) *Server {
-	// Init tls server.
-	initTLSServer()
+	// 要求客户端证书由ca签发且没有被吊销.
+	if certsConfig.RequireClientCert {
+		ServerTLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		ServerTLSConfig.ClientCAs = CertPool
+		ServerTLSConfig.VerifyPeerCertificate = verifyNotRevoked(certs.CRL)
+	}
+}
 
+// NewServer 根据 JSONConfig 创建服务, 配置文件不存在时使用默认配置, 配置错误时返回错误,
+// 避免以不完整的配置运行(如local server不再转发到上游而是直连).
+func NewServer(serverList []string) (*Server, error) {
 	// Make server.
-	s := &Server{}
+	s := &Server{
+		defaultDialer: Direct,
+	}
 
 	ConnectionID = 0
 
 	// open config json file.
+	// 证书位置可以在配置文件中设置, 没有配置文件时使用命令行参数、环境变量或默认路径.
+	certsConfig = CertsConfig{}
+	certsDir = filepath.Dir(JSONConfig)
+
 	file, err := os.Open(JSONConfig)
 	defer file.Close()
 	if err != nil {
 		fmt.Println("Configuration open error:", err)
-		return s
+		initTLSServer()
+		return s, nil
 	}
 
 	configuration := Configuration{
@@ -378,28 +389,94 @@ func NewServer(serverList []string) *Server {
 	decoder := json.NewDecoder(file)
 	err = decoder.Decode(&configuration)
 	if err != nil {
-		fmt.Println("Configuration decode error:", err)
-		return s
+		return nil, fmt.Errorf("configuration decode error: %w", err)
 	}
 
+	// Init tls server.
+	certsConfig = configuration.Certs
+	initTLSServer()
+
 	// 添加到Users容器中.
 	Users = make(map[string]string)
+	Tokens = make(map[string]string)
 	for _, v := range configuration.Users {
 		Users[v.User] = v.Passwd
+		if v.Token != "" {
+			Tokens[v.Token] = v.User
+		}
+	}
+
+	err = checkHTTPAuthConfig(configuration.HTTPAuth)
+	if err != nil {
+		return nil, fmt.Errorf("HTTPAuth config error: %w", err)
+	}
+	httpAuth = newHTTPAuthenticator(configuration.HTTPAuth)
+
+	version := configuration.ProxyProtocol.Send
+	if version != 0 && version != 1 && version != 2 {
+		return nil, fmt.Errorf("ProxyProtocol config error: invalid version %d", version)
+	}
+	trusted, err := parseTrustedCIDRs(configuration.ProxyProtocol.Trusted)
+	if err != nil {
+		return nil, fmt.Errorf("ProxyProtocol config error: %w", err)
+	}
+	s.trustedProxies = trusted
+
+	level := configuration.Websocket.CompressionLevel
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, fmt.Errorf("Websocket config error: invalid compression level %d", level)
+	}
+
+	if _, err := parseEncoding(configuration.Encoding); err != nil {
+		return nil, fmt.Errorf("Encoding config error: %w", err)
+	}
+
+	forwarders, err := parseTrustedCIDRs(configuration.Websocket.Trusted)
+	if err != nil {
+		return nil, fmt.Errorf("Websocket config error: %w", err)
+	}
+	s.trustedForwarders = forwarders
+
+	if err := checkPassthroughConfig(configuration.Passthrough); err != nil {
+		return nil, fmt.Errorf("Passthrough config error: %w", err)
+	}
+
+	// 加载路由规则.
+	router, err := NewRouter(configuration.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("Rules load error: %w", err)
+	}
+
+	s.router = router
+
+	// 创建出站.
+	err = s.initOutbounds(&configuration)
+	if err != nil {
+		return nil, fmt.Errorf("Outbounds init error: %w", err)
 	}
 
 	s.config = configuration
 	ServerVerifyClientCert = configuration.ServerVerifyClientCert
 	Encoding = configuration.Encoding
+	MaxFrameSize = configuration.Websocket.MaxFrameSize
+	MaxMessageSize = configuration.Websocket.MaxMessageSize
+	PingInterval = time.Duration(configuration.Websocket.PingInterval) * time.Second
+	PongTimeout = time.Duration(configuration.Websocket.PongTimeout) * time.Second
+	CompressionLevel = configuration.Websocket.CompressionLevel
+	AlwaysCompress = configuration.Websocket.AlwaysCompress
+	MaxInflationRatio = configuration.Websocket.MaxInflationRatio
 
 	fmt.Println(s.config)
 
-	return s
+	return s, nil
 }
 
 // Start start wserver...
 func (s *Server) Start(addr string) error {
-	go s.StartUnixSocket()
+	// unix socket 只在配置了路径时作为本机入站启动.
+	if s.config.UnixSocket.Path != "" {
+		go s.StartUnixSocket()
+	}
 	return s.StartWithAuth(addr, nil)
 }
 
@@ -408,16 +485,51 @@ func (s *Server) AuthHandleFunc(handler func(string, string) bool) {
 	s.authFunc = handler
 }
 
-// StartUnixSocket ...
+// PasswordHandleFunc 设置http代理Digest认证查询明文密码的函数, 默认使用配置中的Users.
+// 替换 AuthHandleFunc 的用户数据来源时需要同时设置, 否则Digest认证仍然使用Users.
+func (s *Server) PasswordHandleFunc(handler func(user string) (string, bool)) {
+	passwordLookup = configPassword
+	if handler != nil {
+		passwordLookup = handler
+	}
+}
+
+// TokenHandleFunc 设置http代理Bearer认证及socks4令牌查询用户的函数, 默认使用配置中的Token.
+func (s *Server) TokenHandleFunc(handler func(token string) (string, bool)) {
+	tokenLookup = configToken
+	if handler != nil {
+		tokenLookup = handler
+	}
+}
+
+// StartUnixSocket 在unix socket上提供socks5/socks4/http代理服务, 路径及权限由 UnixSocket 配置.
 func (s *Server) StartUnixSocket() error {
-	unixSockName := makeUnixSockName()
+	unixSockName := s.config.UnixSocket.Path
+	if unixSockName == "" {
+		unixSockName = makeUnixSockName()
+	}
+
+	mode, err := s.config.UnixSocket.fileMode()
+	if err != nil {
+		fmt.Println("StartUnixSocket, mode error:", err.Error())
+		return err
+	}
+
 	if err := os.RemoveAll(unixSockName); err != nil {
-		log.Fatal(err)
+		fmt.Println("StartUnixSocket, remove error:", err.Error())
+		return err
 	}
 
 	listen, err := net.Listen("unix", unixSockName)
 	if err != nil {
-		log.Fatal("listen error:", err)
+		fmt.Println("StartUnixSocket, listen error:", err.Error())
+		return err
+	}
+
+	if err := os.Chmod(unixSockName, mode); err != nil {
+		listen.Close()
+		fmt.Println("StartUnixSocket, chmod error:", err.Error())
+		return err
 	}
 
 	s.unixListen = listen
@@ -473,6 +585,10 @@ func (s *Server) StartWithAuth(addr string, handler AuthHander) error {
 
 // Stop stop socks5 server ...
 func (s *Server) Stop() {
-	s.listen.Close()
-	s.unixListen.Close()
+	if s.listen != nil {
+		s.listen.Close()
+	}
+	if s.unixListen != nil {
+		s.unixListen.Close()
+	}
 }